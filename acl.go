@@ -0,0 +1,207 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//最多保留的拒绝访问记录数,超过则淘汰最早的记录
+const MAX_DENIED_ACCESS = 1000
+
+//访问控制中代表所有unix socket调用方的配置
+const ACL_UNIX = "unix"
+
+//服务的访问控制,按照调用方IP或者CIDR允许、拒绝
+//Deny优先,Allow不为空时只允许列表中的IP访问
+type AccessControl struct {
+	Service string   `json:"service"` //服务 uri 或者 uri#groupId,不带分组则对所有分组生效
+	Allow   []string `json:"allow"`   //允许的IP或者CIDR,unix为所有unix socket的调用方
+	Deny    []string `json:"deny"`    //拒绝的IP或者CIDR,unix为所有unix socket的调用方
+}
+
+type accessRule struct {
+	service   string
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	allowUnix bool
+	denyUnix  bool
+}
+
+//访问控制列表
+type AccessList struct {
+	rules []accessRule
+}
+
+func newAccessList(acls []AccessControl) (*AccessList, error) {
+	rules := make([]accessRule, 0, len(acls))
+	for _, acl := range acls {
+		if len(acl.Service) <= 0 {
+			return nil, fmt.Errorf("AccessControl Service Empty! %v", acl)
+		}
+		rule := accessRule{service: acl.Service}
+		for _, s := range acl.Allow {
+			if strings.TrimSpace(s) == ACL_UNIX {
+				rule.allowUnix = true
+				continue
+			}
+			ipnet, err := parseIPNet(s)
+			if nil != err {
+				return nil, fmt.Errorf("AccessControl Allow Invalid! [%s:%s]", acl.Service, s)
+			}
+			rule.allow = append(rule.allow, ipnet)
+		}
+		for _, s := range acl.Deny {
+			if strings.TrimSpace(s) == ACL_UNIX {
+				rule.denyUnix = true
+				continue
+			}
+			ipnet, err := parseIPNet(s)
+			if nil != err {
+				return nil, fmt.Errorf("AccessControl Deny Invalid! [%s:%s]", acl.Service, s)
+			}
+			rule.deny = append(rule.deny, ipnet)
+		}
+		rules = append(rules, rule)
+	}
+	return &AccessList{rules: rules}, nil
+}
+
+//解析IP或者CIDR,单个IP视为完整掩码
+func parseIPNet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		return ipnet, err
+	}
+	ip := net.ParseIP(s)
+	if nil == ip {
+		return nil, fmt.Errorf("Invalid IP %s", s)
+	}
+	if nil != ip.To4() {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+//调用来源 ip:port 中的IP,unix socket的来源 unix://path#序号 返回 unix://path
+func sourceIP(source string) string {
+	if strings.HasPrefix(source, LISTENER_UNIX) {
+		if idx := strings.LastIndex(source, "#"); idx > 0 {
+			return source[:idx]
+		}
+		return source
+	}
+	if host, _, err := net.SplitHostPort(source); nil == err {
+		return host
+	}
+	return source
+}
+
+func containsIP(ipnets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range ipnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//调用方是否允许访问服务,所有匹配服务的规则都需要允许,拒绝时返回原因
+func (self *AccessList) Allow(source, serviceUri, groupId string) (string, bool) {
+	if nil == self || len(self.rules) <= 0 {
+		return "", true
+	}
+	unix := strings.HasPrefix(source, LISTENER_UNIX)
+	ip := net.ParseIP(sourceIP(source))
+	for _, rule := range self.rules {
+		if rule.service != serviceUri && rule.service != BuildServiceUri(serviceUri, groupId) {
+			continue
+		}
+		restricted := len(rule.allow) > 0 || rule.allowUnix
+		//unix socket的调用方只匹配unix
+		if unix {
+			if rule.denyUnix {
+				return "deny", false
+			}
+			if restricted && !rule.allowUnix {
+				return "not in allow", false
+			}
+			continue
+		}
+		//无法解析的来源只有没有任何限制时才允许
+		if nil == ip {
+			return "invalid source", false
+		}
+		if containsIP(rule.deny, ip) {
+			return "deny", false
+		}
+		if restricted && !containsIP(rule.allow, ip) {
+			return "not in allow", false
+		}
+	}
+	return "", true
+}
+
+//被拒绝的访问
+type DeniedAccess struct {
+	Source  string `json:"source"`
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	Reason  string `json:"reason"`
+	Count   int64  `json:"count"`
+	Last    int64  `json:"last"` //最后一次被拒绝的时间 unix ms
+}
+
+//按照来源、服务、方法汇总的拒绝访问记录
+type deniedAccessLog struct {
+	lock    sync.Mutex
+	entries map[string]*DeniedAccess
+}
+
+func (self *deniedAccessLog) add(source, serviceUri, method, reason string, now time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if nil == self.entries {
+		self.entries = make(map[string]*DeniedAccess, 16)
+	}
+	key := source + "|" + serviceUri + "|" + method
+	entry, ok := self.entries[key]
+	if !ok {
+		if len(self.entries) >= MAX_DENIED_ACCESS {
+			//淘汰最早的记录
+			oldest := ""
+			for k, e := range self.entries {
+				if len(oldest) <= 0 || e.Last < self.entries[oldest].Last {
+					oldest = k
+				}
+			}
+			delete(self.entries, oldest)
+		}
+		entry = &DeniedAccess{Source: source, Service: serviceUri, Method: method}
+		self.entries[key] = entry
+	}
+	entry.Reason = reason
+	entry.Count++
+	entry.Last = now.UnixNano() / int64(time.Millisecond)
+}
+
+//按照最后拒绝时间倒序
+func (self *deniedAccessLog) list() []DeniedAccess {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	denied := make([]DeniedAccess, 0, len(self.entries))
+	for _, e := range self.entries {
+		denied = append(denied, *e)
+	}
+	sort.Slice(denied, func(i, j int) bool {
+		if denied[i].Last != denied[j].Last {
+			return denied[i].Last > denied[j].Last
+		}
+		return denied[i].Source < denied[j].Source
+	})
+	return denied
+}
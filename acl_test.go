@@ -0,0 +1,152 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	if _, err := newAccessList([]AccessControl{{Service: "/service/lookup", Allow: []string{"10.0.0.0/33"}}}); nil == err {
+		t.Fatal("invalid cidr should fail")
+	}
+	if _, err := newAccessList([]AccessControl{{Allow: []string{"10.0.0.1"}}}); nil == err {
+		t.Fatal("empty service should fail")
+	}
+
+	acl, err := newAccessList([]AccessControl{
+		{Service: "/service/lookup", Allow: []string{"10.0.0.0/8", "::1"}, Deny: []string{"10.0.1.0/24"}},
+		{Service: "/service/lookup#g1", Deny: []string{"10.0.2.1"}},
+		{Service: "/service/local", Allow: []string{"unix"}},
+		{Service: "/service/remote", Deny: []string{"unix"}},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		source, uri, group string
+		allow              bool
+	}{
+		{"10.0.0.1:1000", "/service/lookup", "*", true},
+		{"[::1]:1000", "/service/lookup", "*", true},
+		{"10.0.1.1:1000", "/service/lookup", "*", false},
+		{"192.168.0.1:1000", "/service/lookup", "*", false},
+		//不带分组的规则对所有分组生效
+		{"192.168.0.1:1000", "/service/lookup", "g2", false},
+		{"10.0.2.1:1000", "/service/lookup", "*", true},
+		{"10.0.2.1:1000", "/service/lookup", "g1", false},
+		//没有规则的服务不限制
+		{"192.168.0.1:1000", "/service/other", "*", true},
+		{"unknown", "/service/lookup", "*", false},
+		//unix socket的调用方只匹配unix
+		{"unix:///tmp/moa.sock#1", "/service/lookup", "*", false},
+		{"unix:///tmp/moa.sock#1", "/service/local", "*", true},
+		{"127.0.0.1:1000", "/service/local", "*", false},
+		{"unix:///tmp/moa.sock#1", "/service/remote", "*", false},
+		{"127.0.0.1:1000", "/service/remote", "*", true},
+		{"unix:///tmp/moa.sock#1", "/service/other", "*", true},
+	}
+	for _, c := range cases {
+		if reason, ok := acl.Allow(c.source, c.uri, c.group); ok != c.allow {
+			t.Fatalf("%s %s#%s expect %v got %v %s", c.source, c.uri, c.group, c.allow, ok, reason)
+		}
+	}
+}
+
+func TestDeniedAccessLog(t *testing.T) {
+	var denied deniedAccessLog
+	now := time.Now()
+	for i := 0; i < MAX_DENIED_ACCESS+1; i++ {
+		denied.add("10.0.0.1", "/service/lookup", string(rune('a'+i%26))+string(rune('a'+i/26)), "deny",
+			now.Add(time.Duration(i)*time.Millisecond))
+	}
+	denied.add("10.0.0.1", "/service/lookup", "ka", "deny", now.Add(time.Hour))
+
+	list := denied.list()
+	if len(list) != MAX_DENIED_ACCESS {
+		t.Fatalf("denied access should be evicted %d", len(list))
+	}
+	if list[0].Method != "ka" || list[0].Count != 2 {
+		t.Fatalf("latest denied access should be first %v", list[0])
+	}
+	//最早的记录被淘汰
+	for _, d := range list {
+		if d.Method == "aa" {
+			t.Fatal("oldest denied access should be evicted")
+		}
+	}
+}
+
+func TestFileRegistryAccessControls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moa-acl")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cluster.yaml")
+
+	registry := NewFileRegistry(path, []string{"/service/lookup"}, true)
+	if acls, err := registry.GetAccessControls(PROTOCOL, "/service/lookup"); nil != err || len(acls) != 0 {
+		t.Fatalf("no acls expected without file %v %v", acls, err)
+	}
+
+	yaml := `
+acls:
+  - service_uri: "/service/lookup"
+    gid: ""
+    allow:
+      - "10.0.0.0/8"
+  - service_uri: "/service/lookup"
+    gid: "g1"
+    deny:
+      - "10.0.1.1"
+  - service_uri: "/service/other"
+    deny:
+      - "10.0.1.1"
+`
+	if err := ioutil.WriteFile(path, []byte(yaml), 0644); nil != err {
+		t.Fatal(err)
+	}
+	acls, err := registry.GetAccessControls(PROTOCOL, "/service/lookup#g1")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(acls) != 2 || acls[0].Service != "/service/lookup" || acls[1].Service != "/service/lookup#g1" {
+		t.Fatalf("unexpected acls %v", acls)
+	}
+}
+
+//不带分组的请求分发到唯一的分组服务时,按照分组服务的规则校验
+func TestCheckAccessResolvedGroup(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "/service/lookup", GroupId: "a",
+		Instance: demo, Interface: (*IHello)(nil)}}, stat)
+	acl, err := newAccessList([]AccessControl{{Service: "/service/lookup#a", Deny: []string{"10.0.0.1"}}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	app := &Application{invokeHandler: handler, moaStat: stat, accessList: acl}
+
+	for _, action := range []string{"/service/lookup", "/service/lookup#*"} {
+		req := MoaRawReqPacket{ServiceUri: action, Source: "10.0.0.1:1000"}
+		req.Params.Method = "GetService"
+		if resp, ok := app.checkAccess(req); ok || resp.ErrCode != CODE_IP_NOT_ALLOWED {
+			t.Fatalf("%s should be denied by /service/lookup#a %v", action, resp)
+		}
+	}
+	if denied := app.denied.list(); len(denied) != 1 || denied[0].Service != "/service/lookup#a" {
+		t.Fatalf("denied access should be recorded on resolved service %v", denied)
+	}
+
+	req := MoaRawReqPacket{ServiceUri: "/service/lookup", Source: "10.0.0.2:1000"}
+	req.Params.Method = "GetService"
+	if _, ok := app.checkAccess(req); !ok {
+		t.Fatal("other source should be allowed")
+	}
+}
@@ -3,20 +3,22 @@ package core
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/blackbeans/logx"
-	"github.com/google/gops/agent"
 	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/uber/jaeger-client-go"
 	jaegercfg "github.com/uber/jaeger-client-go/config"
 	"html/template"
-	"net"
 	"net/http"
 	"net/http/pprof"
 	"sort"
 	"strings"
-
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blackbeans/turbo"
@@ -37,6 +39,9 @@ func init() {
 		MoaProfile{Name: "list.clients", Href: "/debug/moa/list/clients", Desc: "MOA当前所有连接"},
 		MoaProfile{Name: "list.services", Href: "/debug/moa/list/services", Desc: "MOA发布的服务列表"},
 		MoaProfile{Name: "list.methods", Href: "/debug/moa/list/methods", Desc: "MOA来源调用统计信息"},
+		MoaProfile{Name: "list.bulkheads", Href: "/debug/moa/list/bulkheads", Desc: "MOA服务和方法的并发限制"},
+		MoaProfile{Name: "list.denied", Href: "/debug/moa/list/denied", Desc: "MOA访问控制拒绝的调用"},
+		MoaProfile{Name: "cache.purge", Href: "/debug/moa/cache/purge", Desc: "MOA清除方法结果缓存(POST)"},
 		MoaProfile{Name: "metrics", Href: "/metrics", Desc: "prometheus metrics"},
 	}
 }
@@ -46,16 +51,48 @@ type ServiceBundle func() []Service
 var log = logx.GetLogger("moa-server")
 
 type Application struct {
+	//正在处理中的调用数量
+	inflight int64
+	//是否正在关闭 1:关闭中
+	shutdown int32
+	//是否已经启动 1:已启动
+	started int32
+
 	ctx  context.Context
 	stop context.CancelFunc
 	http.Handler
-	remoting      *turbo.TServer
+	remoting IListener
+	config   *turbo.TConfig
+	admin    *http.Server
+	//所有的监听,包括remoting
+	listeners     []IListener
+	listenerNames []string
 	invokeHandler *InvocationHandler
 	options       Option
 	//任务处理
 	invokePool   *turbo.GPool
 	configCenter *ConfigCenter
 	moaStat      *MoaStat
+	//每个Application独立的指标,同一进程中的多个Application互不冲突
+	metrics *prometheus.Registry
+	//限流和访问控制
+	rateLimiter *RateLimiter
+	accessList  *AccessList
+	//调用方认证,没有开启为nil
+	authenticator *Authenticator
+	//注册中心下发的访问控制,拉取失败时继续使用
+	remoteAcls []AccessControl
+	//访问控制拒绝的调用
+	denied deniedAccessLog
+	//配置文件路径,用于热更新
+	configPath string
+	//保护options、invokePool、rateLimiter、accessList、authenticator的热更新
+	optionLock sync.RWMutex
+	reloadLock sync.Mutex
+	//进行中的调用,key:client#opaque value:*userCancel
+	calls sync.Map
+	//进行中的流式响应,key:client#opaque value:*streamWindow
+	streams sync.Map
 }
 
 func NewApplicationWithContext(ctx context.Context, configPath string, bundle ServiceBundle, monitor func(serviceUri, host string, moainfo MoaInfo)) *Application {
@@ -63,16 +100,53 @@ func NewApplicationWithContext(ctx context.Context, configPath string, bundle Se
 }
 
 func initApplication(ctx context.Context, configPath string, bundle ServiceBundle, monitor func(serviceUri, host string, moainfo MoaInfo)) *Application {
-	log = logx.GetLogger("moa-server")
-	services := bundle()
 	options, err := LoadConfiguration(configPath)
 	if nil != err {
 		panic(err)
 	}
 
-	serverOp := InitServerOption(options)
+	app, err := NewApplicationWithOption(ctx, options, bundle, monitor)
+	if nil != err {
+		panic(err)
+	}
 
-	cloneServs := make([]Service, 0, len(services))
+	err = app.Start()
+	if nil != err {
+		panic(err)
+	}
+	//配置文件变更热更新
+	app.WatchConfiguration(configPath)
+	return app
+}
+
+//使用Option直接创建Application,所有的失败都以error返回
+//创建成功后需要调用Start启动,Stop关闭
+func NewApplicationWithOption(ctx context.Context, options Option, bundle ServiceBundle, monitor func(serviceUri, host string, moainfo MoaInfo)) (*Application, error) {
+	log = logx.GetLogger("moa-server")
+	services := bundle()
+	if len(services) <= 0 {
+		return nil, errors.New("Application|No Services Found!")
+	}
+
+	serverOp, err := initServerOption(fillDefaults(options))
+	if nil != err {
+		return nil, err
+	}
+
+	rateLimiter, err := newRateLimiter(serverOp.RateLimits)
+	if nil != err {
+		return nil, err
+	}
+
+	accessList, err := newAccessList(serverOp.AccessControls)
+	if nil != err {
+		return nil, err
+	}
+
+	authenticator, err := newAuthenticator(serverOp.Auth.Enabled, serverOp.Auth.Keys, serverOp.Auth.Window)
+	if nil != err {
+		return nil, err
+	}
 
 	for i, s := range services {
 		//服务分默认不配置是使用*分组
@@ -82,19 +156,11 @@ func initApplication(ctx context.Context, configPath string, bundle ServiceBundl
 		//是否是预发环境
 		s.IsPre = serverOp.Server.IsPre
 		services[i] = s
-		cloneServs = append(cloneServs, s)
 	}
 
 	name := serverOp.Server.BindAddress
 	cluster := serverOp.Clusters[serverOp.Server.RunMode]
-	config := turbo.NewTConfig(name,
-		cluster.MaxDispatcherSize,
-		cluster.ReadBufferSize,
-		cluster.ReadBufferSize,
-		cluster.WriteChannelSize,
-		cluster.ReadChannelSize,
-		cluster.IdleTimeout,
-		50*10000)
+	config := newTConfig(name, cluster)
 
 	// tracing
 	if !opentracing.IsGlobalTracerRegistered() {
@@ -117,11 +183,6 @@ func initApplication(ctx context.Context, configPath string, bundle ServiceBundl
 		opentracing.SetGlobalTracer(tracer)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
-	invokePool := turbo.NewLimitPool(
-		ctx,
-		cluster.MaxDispatcherSize)
-
 	//是否启用snappy
 	snappy := false
 	if strings.ToLower(serverOp.Server.Compress) == "snappy" {
@@ -134,64 +195,121 @@ func initApplication(ctx context.Context, configPath string, bundle ServiceBundl
 	}
 
 	//创建注册服务
-	configCenter := NewConfigCenter(cluster.Registry,
+	configCenter, err := newConfigCenter(cluster.Registry,
 		serverOp.Server.BindAddress,
 		services)
+	if nil != err {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	invokePool := turbo.NewLimitPool(
+		ctx,
+		cluster.MaxDispatcherSize)
 
 	app := &Application{}
-	app.options = options
+	app.options = serverOp
 	app.configCenter = configCenter
 	app.invokePool = invokePool
+	app.rateLimiter = rateLimiter
+	app.accessList = accessList
+	app.authenticator = authenticator
+	app.config = config
 	app.ctx = ctx
 	app.stop = cancel
-	//启动remoting
-	remoting := turbo.NewTServerWithCodec(
-		serverOp.Server.BindAddress,
-		config,
-		codec,
-		func(ctx *turbo.TContext) error {
-			dis(app, ctx)
-			return nil
+	onMessage := func(ctx *turbo.TContext) error {
+		dis(app, ctx.Client, ctx.Message, ctx.Err)
+		return nil
+	}
+	onUnixMessage := func(client RemoteClient, message *turbo.Packet, err error) {
+		dis(app, client, message, err)
+	}
+	//remoting
+	app.remoting = newManagedListener(func() IListener {
+		return NewTcpServer(
+			serverOp.Server.BindAddress,
+			config,
+			codec,
+			onMessage)
+	})
+	app.listeners = []IListener{app.remoting}
+	app.listenerNames = []string{serverOp.Server.BindAddress}
+
+	//额外的监听地址,使用相同的InvocationHandler但是不发布到注册中心
+	for _, address := range serverOp.Server.Listeners {
+		network, addr, err := parseListenAddress(address)
+		if nil != err {
+			cancel()
+			configCenter.registry.Destroy()
+			return nil, err
+		}
+		tconfig := newTConfig(address, cluster)
+		listener := newManagedListener(func() IListener {
+			if network == "unix" {
+				return NewUnixServer(addr, tconfig, cluster.MaxDispatcherSize,
+					codec, onUnixMessage)
+			}
+			return NewTcpServer(addr, tconfig, codec, onMessage)
 		})
-	app.remoting = remoting
-	err = remoting.ListenAndServer()
-	if nil != err {
-		panic(err)
+		app.listeners = append(app.listeners, listener)
+		app.listenerNames = append(app.listenerNames, address)
 	}
 
 	//moastat
-	moaStat := NewMoaStat(serverOp.Server.BindAddress,
+	app.metrics = prometheus.NewRegistry()
+	app.metrics.MustRegister(collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	moaStat, err := NewMoaStat(serverOp.Server.BindAddress,
 		services[0].ServiceUri, invokePool,
 		monitor,
-		func() turbo.NetworkStat {
-			return app.remoting.NetworkStat()
-
-		})
+		func() map[string]turbo.NetworkStat {
+			stats := make(map[string]turbo.NetworkStat, len(app.listeners))
+			for i, l := range app.listeners {
+				stats[app.listenerNames[i]] = l.NetworkStat()
+			}
+			return stats
+		}, app.metrics)
+	if nil != err {
+		cancel()
+		configCenter.registry.Destroy()
+		return nil, err
+	}
 	app.moaStat = moaStat
 
-	app.invokeHandler = NewInvocationHandler(services, moaStat)
-	moaStat.StartLog()
-
-	//------------启动pprof
-	// 启动 moa 系统指标状态 暴露http接口
-	// 包括 pprof、自定义moa状态信息、prometheus metrics
-	go func() {
-		hp, _ := net.ResolveTCPAddr("tcp4", serverOp.Server.BindAddress)
-		pprofListen := fmt.Sprintf("%s:%d", hp.IP, hp.Port+1000)
+	app.invokeHandler, err = newInvocationHandler(services, moaStat)
+	if nil != err {
+		cancel()
+		moaStat.Destroy()
+		configCenter.registry.Destroy()
+		return nil, err
+	}
+	app.invokeHandler.SetSlowLogThreshold(cluster.SlowLogThreshold)
+	app.invokeHandler.SetProcessTimeout(cluster.ProcessTimeout)
+	//合并注册中心下发的访问控制
+	if err := app.reloadAccessControls(serverOp.AccessControls); nil != err {
+		log.Errorf("Application|AccessControl|Reload|FAIL|%v", err)
+	}
+	return app, nil
+}
 
-		for _, pro := range profiles {
-			http.HandleFunc(pro.Href, app.ServeHTTP)
-		}
-		log.Error(http.ListenAndServe(pprofListen, nil))
-		if err := agent.Listen(agent.Options{ShutdownCleanup: true}); err != nil {
-			log.Errorf("Gops Start  FAIL %s ...", err)
-		}
-	}()
+//启动Application: 监听端口、启动状态统计、发布服务
+func (self *Application) Start() error {
+	if !atomic.CompareAndSwapInt32(&self.started, 0, 1) {
+		return errors.New("Application|Start|Already Started!")
+	}
 
-	//注册服务
-	configCenter.RegisteAllServices()
-	log.Infof("Application|Start|SUCC|%s|%s", name, serverOp.Server.BindAddress)
+	serverOp := self.options
+	if err := self.start(); nil != err {
+		self.rollback()
+		atomic.StoreInt32(&self.started, 0)
+		log.Errorf("Application|Start|FAIL|%s|%v", serverOp.Server.BindAddress, err)
+		return err
+	}
+	log.Infof("Application|Start|SUCC|%s", serverOp.Server.BindAddress)
+	self.watchAccessControls()
 
+	ctx := self.ctx
+	config := self.config
 	config.TW.RepeatedTimer(60*time.Second, func(tid uint32, t time.Time) {
 		select {
 		case <-ctx.Done():
@@ -201,9 +319,9 @@ func initApplication(ctx context.Context, configPath string, bundle ServiceBundl
 
 		}
 
-		allclients := remoting.ListClients()
+		allclients := self.listClients()
 		sort.Strings(allclients)
-		for _, inst := range app.invokeHandler.instances {
+		for _, inst := range self.invokeHandler.Services() {
 			removeClients := make([]string, 0, 2)
 			inst.InvokesPerClient.Range(func(key, value interface{}) bool {
 				clientip := key.(string)
@@ -219,37 +337,144 @@ func initApplication(ctx context.Context, configPath string, bundle ServiceBundl
 			}
 		}
 	}, nil)
-	return app
+	return nil
+}
+
+//依次启动监听、admin、状态统计并发布服务
+func (self *Application) start() error {
+	//启动所有的监听
+	for i, l := range self.listeners {
+		if err := l.ListenAndServer(); nil != err {
+			return err
+		}
+		log.Infof("Application|Start|Listen|SUCC|%s", self.listenerNames[i])
+	}
+
+	//------------启动admin
+	// 启动 moa 系统指标状态 暴露http接口
+	if err := self.startAdmin(); nil != err {
+		return err
+	}
+
+	self.moaStat.StartLog()
+
+	//注册服务,只发布BindAddress
+	return self.configCenter.registeAllServices()
+}
+
+//Start失败时撤销已经启动的部分,之后可以重新Start
+func (self *Application) rollback() {
+	self.moaStat.StopLog()
+	self.stopAdmin()
+	self.admin = nil
+	for _, l := range self.listeners {
+		l.Shutdown()
+	}
+}
+
+//所有监听上的客户端
+func (self *Application) listClients() []string {
+	clients := make([]string, 0, 10)
+	for _, l := range self.listeners {
+		clients = append(clients, l.ListClients()...)
+	}
+	return clients
+}
+
+//注册服务端拦截器,按照注册顺序由外向内执行
+func (self *Application) UseInterceptor(interceptors ...Interceptor) {
+	self.invokeHandler.Use(interceptors...)
+}
+
+//运行时发布服务
+func (self *Application) AddService(s Service) error {
+	//服务分默认不配置是使用*分组
+	if len(s.GroupId) <= 0 {
+		s.GroupId = "*"
+	}
+	//是否是预发环境
+	s.IsPre = self.currentOption().Server.IsPre
+
+	err := self.invokeHandler.AddService(s)
+	if nil != err {
+		return err
+	}
+	//注册到配置中心,失败则回滚
+	err = self.configCenter.AddService(s)
+	if nil != err {
+		self.invokeHandler.removeService(s.ServiceUri, s.GroupId)
+		return err
+	}
+	log.Infof("Application|AddService|SUCC|%s|%s", s.ServiceUri, s.GroupId)
+	return nil
+}
+
+//运行时下线服务,先从配置中心注销再停止处理
+//serviceUri#groupId只下线该分组,否则下线所有分组
+func (self *Application) RemoveService(serviceUri string) error {
+	unregisted := self.configCenter.RemoveService(serviceUri)
+	removed := self.invokeHandler.RemoveService(serviceUri)
+	if !unregisted && !removed {
+		return fmt.Errorf("Application|RemoveService|Not Found|%s", serviceUri)
+	}
+	log.Infof("Application|RemoveService|SUCC|%s", serviceUri)
+	return nil
+}
+
+//关闭Application
+func (self *Application) Stop() {
+	self.DestroyApplication()
 }
 
-func (self Application) DestroyApplication() {
+func (self *Application) DestroyApplication() {
+
+	//标记为关闭中,新的请求直接拒绝让客户端切换节点
+	if !atomic.CompareAndSwapInt32(&self.shutdown, 0, 1) {
+		return
+	}
 
 	//取消注册服务
 	self.configCenter.Destroy()
 
-	// 通过查看 moaStat 中的Connections数量来确保当前没有连接
-	// 每秒检查一次，等待 10s
-	checkTimes := 0
-	for checkTimes < 9 {
-		log.Infof("Application|DestroyApplication|WaitProcess|Times:%d|Conns:%d", checkTimes, self.moaStat.preMoaInfo.Connections)
-		if self.moaStat.preMoaInfo.Connections == 0 {
-			log.Infof("Application|DestroyApplication|WaitProcess|Done")
-			break
-		}
-		time.Sleep(time.Second)
-		checkTimes += 1
-	}
+	//等待所有已经提交的调用写完响应,最多等待ShutdownTimeout
+	self.drain(self.currentOption().Server.ShutdownTimeout)
 
 	self.stop()
 	time.Sleep(500 * time.Millisecond)
 
-	//关闭remoting
-	self.remoting.Shutdown()
+	//关闭所有的监听
+	for _, l := range self.listeners {
+		l.Shutdown()
+	}
+	self.stopAdmin()
 	self.moaStat.Destroy()
 }
 
+//等待正在处理的调用全部完成
+func (self *Application) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		inflight := atomic.LoadInt64(&self.inflight)
+		if inflight <= 0 {
+			log.Infof("Application|DestroyApplication|Drain|Done")
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Warnf("Application|DestroyApplication|Drain|Timeout|Inflight:%d", inflight)
+			return false
+		}
+		log.Infof("Application|DestroyApplication|Drain|Inflight:%d", inflight)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//是否正在关闭
+func (self *Application) isShutdown() bool {
+	return atomic.LoadInt32(&self.shutdown) == 1
+}
+
 //需要开发对应的分包
-func dis(self *Application, ctx *turbo.TContext) {
+func dis(self *Application, client RemoteClient, p *turbo.Packet, perr error) {
 
 	defer func() {
 		if err := recover(); nil != err {
@@ -257,14 +482,13 @@ func dis(self *Application, ctx *turbo.TContext) {
 		}
 	}()
 
-	p := ctx.Message
 	//如果是错误的，那么久直接写出错误的响应给客户端
-	if nil != ctx.Err {
+	if nil != perr {
 		resp := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
-		resp.PayLoad = MoaRespPacket{ErrCode: CODE_THROWABLE, Message: fmt.Sprintf("%v", ctx.Err)}
+		resp.PayLoad = MoaRespPacket{ErrCode: CODE_THROWABLE, Message: fmt.Sprintf("%v", perr)}
 		//需要发送调用的错误给客户端
 		log.Errorf("Application|Err|Process|%v", resp)
-		ctx.Client.Write(*resp)
+		client.Write(*resp)
 		return
 	}
 	//如果是get命令
@@ -272,46 +496,120 @@ func dis(self *Application, ctx *turbo.TContext) {
 
 		req := p.PayLoad.(MoaRawReqPacket)
 		//这里面根据解析包的内容得到调用不同的service获得结果
-		req.Source = ctx.Client.RemoteAddr()
-		req.Timeout = self.options.Clusters[self.options.Server.RunMode].ProcessTimeout
+		req.Source = client.RemoteAddr()
+		option := self.currentOption()
+
+		//先计数再判断是否关闭，保证drain时不会漏掉刚进来的请求
+		atomic.AddInt64(&self.inflight, 1)
+		if self.isShutdown() {
+			atomic.AddInt64(&self.inflight, -1)
+			resp := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
+			resp.PayLoad = MoaRespPacket{ErrCode: CODE_SERVER_SHUTDOWN,
+				Message: fmt.Sprintf(MSG_SERVER_SHUTDOWN, option.Server.BindAddress)}
+			log.Warnf("Application|Shutdown|Reject|Source:%s|%s|%s",
+				req.Source, req.ServiceUri, req.Params.Method)
+			client.Write(*resp)
+			return
+		}
+
+		//访问控制
+		if denied, ok := self.checkAccess(req); !ok {
+			atomic.AddInt64(&self.inflight, -1)
+			resp := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
+			resp.PayLoad = denied
+			client.Write(*resp)
+			return
+		}
+
+		//调用方认证
+		caller, unauthorized, ok := self.authenticate(&req)
+		if !ok {
+			atomic.AddInt64(&self.inflight, -1)
+			resp := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
+			resp.PayLoad = unauthorized
+			client.Write(*resp)
+			return
+		}
+
 		//是否已经超时过期了，那么久不用执行调用了
-		if req.CreateTime > 0 && (time.Now().UnixNano()-req.CreateTime*int64(time.Millisecond)) >= int64(req.Timeout) {
-			log.Warnf("InvocationHandler|Invoke|Timeout|Source:%s|Timeout[%d]ms|%s|%s",
-				req.Source, req.Timeout/time.Millisecond, req.ServiceUri, req.Params.Method)
+		deadline, ok := self.prepareRequest(&req, time.Now())
+		if !ok {
+			atomic.AddInt64(&self.inflight, -1)
+		} else if limited, ok := self.rateLimit(req); !ok {
+			atomic.AddInt64(&self.inflight, -1)
+			resp := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
+			resp.PayLoad = limited
+			client.Write(*resp)
 		} else {
 			//全异步
-			timeoutCtx, cancel := context.WithTimeout(self.ctx, req.Timeout)
-			self.invokePool.Queue(timeoutCtx, func(cctx context.Context) (interface{}, error) {
-				defer func() {
-					cancel()
-				}()
-				//设置当前的调用的属性线程上下文
-				invokeCtx := context.WithValue(cctx, KEY_MOA_PROPERTIES, req.Properties)
+			timeoutCtx, cancel := context.WithDeadline(self.ctx, deadline)
+			//调用方可以通过CANCEL取消本次调用
+			callKey := invocationKey(req.Source, p.Header.Opaque)
+			cancelCtx, userCancel := withUserCancel(timeoutCtx)
+			self.calls.Store(callKey, userCancel)
+			finish := func() {
+				cancel()
+				self.calls.Delete(callKey)
+				atomic.AddInt64(&self.inflight, -1)
+			}
+			self.queueInvocation(timeoutCtx, func() {
+				defer finish()
+				//设置当前的调用的属性线程上下文以及认证的调用方
+				invokeCtx := withMoaCaller(context.WithValue(cancelCtx, KEY_MOA_PROPERTIES, req.Properties), caller)
 				self.invokeHandler.Invoke(invokeCtx, req, func(resp MoaRespPacket) error {
-					respPacker := turbo.NewRespPacket(ctx.Message.Header.Opaque, RESP, nil)
+					//已经取消的调用不再写响应
+					if resp.ErrCode == CODE_USER_CANCELLED {
+						log.Infof("InvocationHandler|Invoke|Cancelled|Source:%s|%s|%s",
+							req.Source, req.ServiceUri, req.Params.Method)
+						return nil
+					}
+					//流式方法逐帧写出
+					if stream, ok := resp.Result.(*ResultStream); ok {
+						self.writeStream(invokeCtx, client, p.Header.Opaque, req, stream)
+						return nil
+					}
+					respPacker := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
 					respPacker.PayLoad = resp
 					if resp.ErrCode != 0 && resp.ErrCode != CODE_SERVER_SUCC {
 						//需要发送调用的错误给客户端
 						log.Errorf("InvocationHandler|Invoke|FAIL|Source:%s|Timeout[%d]ms|%s|%s|%d",
 							req.Source, req.Timeout/time.Millisecond, req.ServiceUri, req.Params.Method, resp.ErrCode)
 					}
-					return ctx.Client.Write(*respPacker)
+					return client.Write(*respPacker)
 				})
-				return nil, nil
+			}, func(err error) {
+				//没有执行的调用和超时一样不写响应
+				finish()
+				log.Errorf("Application|Queue|FAIL|%v|Source:%s|%s|%s",
+					err, req.Source, req.ServiceUri, req.Params.Method)
 			})
-
 		}
 		//log.DebugLog("moa", "Application|packetDispatcher|SUCC|%s", *resp)
 
+	} else if p.Header.CmdType == BATCH {
+		//BATCH 协议，批量调用
+		self.dispatchBatch(client, p)
 	} else if p.Header.CmdType == PING {
 		//PING 协议
 		pipo, ok := p.PayLoad.(PiPo)
 		if ok {
-			ctx.Client.Pong(p.Header.Opaque, pipo.Timestamp)
+			client.Pong(p.Header.Opaque, pipo.Timestamp)
 		}
 		resp := turbo.NewRespPacket(p.Header.Opaque, PONG, nil)
 		resp.PayLoad = pipo
-		ctx.Client.Write(*resp)
+		client.Write(*resp)
+	} else if p.Header.CmdType == CANCEL {
+		//CANCEL 协议，取消进行中的调用，被取消的调用不写响应
+		cancel, ok := p.PayLoad.(MoaCancelPacket)
+		if ok {
+			self.cancelInvocation(client.RemoteAddr(), cancel.Opaque)
+		}
+	} else if p.Header.CmdType == STREAM_ACK {
+		//STREAM_ACK 协议，调用方确认消费后增加流控窗口
+		ack, ok := p.PayLoad.(MoaStreamAckPacket)
+		if ok {
+			self.ackStream(client.RemoteAddr(), ack.Opaque, ack.Credits)
+		}
 	} else if p.Header.CmdType == INFO {
 		//INFO 协议，返回服务端信息
 		stat := make(map[string]interface{}, 2)
@@ -319,11 +617,165 @@ func dis(self *Application, ctx *turbo.TContext) {
 		stat["moa"] = self.moaStat.GetMoaInfo()
 		resp := turbo.NewRespPacket(p.Header.Opaque, INFO, nil)
 		resp.PayLoad = stat
-		ctx.Client.Write(*resp)
+		client.Write(*resp)
 	}
 
 }
 
+//提交调用到invokePool,run和skip有且只有一个会被执行
+//提交失败或者调用开始执行前ctx已经结束(invokePool会直接丢弃)时执行skip
+func (self *Application) queueInvocation(ctx context.Context, run func(), skip func(err error)) {
+	state := int32(0)
+	_, err := self.currentInvokePool().Queue(ctx, func(cctx context.Context) (interface{}, error) {
+		if atomic.CompareAndSwapInt32(&state, 0, 1) {
+			run()
+		}
+		return nil, nil
+	})
+	if nil != err {
+		if atomic.CompareAndSwapInt32(&state, 0, 2) {
+			skip(err)
+		}
+		return
+	}
+	//ctx结束时还没有开始执行则认为被丢弃
+	go func() {
+		<-ctx.Done()
+		if atomic.CompareAndSwapInt32(&state, 0, 2) {
+			skip(ctx.Err())
+		}
+	}()
+}
+
+//进行中调用的key
+func invocationKey(source string, opaque uint32) string {
+	return fmt.Sprintf("%s#%d", source, opaque)
+}
+
+//取消客户端进行中的调用
+func (self *Application) cancelInvocation(source string, opaque uint32) bool {
+	call, ok := self.calls.Load(invocationKey(source, opaque))
+	if !ok {
+		log.Infof("Application|Cancel|NotFound|Source:%s|Opaque:%d", source, opaque)
+		return false
+	}
+	call.(*userCancel).Cancel()
+	log.Infof("Application|Cancel|SUCC|Source:%s|Opaque:%d", source, opaque)
+	return true
+}
+
+//请求实际分发到的服务和分组,访问控制和限流按照分发后的服务匹配,
+//避免不带分组或者分组为*的请求绕过分组服务上的规则
+func (self *Application) resolveService(req MoaRawReqPacket) (string, string) {
+	uri, group := requestServiceUri(req.ServiceUri, req.Properties)
+	if nil == self.invokeHandler {
+		return uri, group
+	}
+	return self.invokeHandler.resolveService(uri, group)
+}
+
+//按照访问控制判断调用方是否允许访问服务,拒绝则返回对应的响应
+func (self *Application) checkAccess(req MoaRawReqPacket) (MoaRespPacket, bool) {
+	uri, group := self.resolveService(req)
+	reason, ok := self.currentAccessList().Allow(req.Source, uri, group)
+	if ok {
+		return MoaRespPacket{}, true
+	}
+	ip := sourceIP(req.Source)
+	self.denied.add(ip, BuildServiceUri(uri, group), req.Params.Method, reason, time.Now())
+	log.Warnf("Application|AccessControl|Deny|%s|Source:%s|%s|%s",
+		reason, req.Source, req.ServiceUri, req.Params.Method)
+	return MoaRespPacket{ErrCode: CODE_IP_NOT_ALLOWED,
+		Message: fmt.Sprintf(MSG_IP_NOT_ALLOWED, ip)}, false
+}
+
+//校验调用方签名,没有开启认证则直接通过,认证失败返回对应的响应
+func (self *Application) authenticate(req *MoaRawReqPacket) (string, MoaRespPacket, bool) {
+	authenticator := self.currentAuthenticator()
+	if nil == authenticator {
+		return "", MoaRespPacket{}, true
+	}
+	caller, err := authenticator.Authenticate(*req, time.Now())
+	if nil != err {
+		log.Warnf("Application|Auth|FAIL|%v|App:%s|Source:%s|%s|%s",
+			err, caller, req.Source, req.ServiceUri, req.Params.Method)
+		return "", MoaRespPacket{ErrCode: CODE_AUTH_FAILED,
+			Message: fmt.Sprintf(MSG_AUTH_FAILED, err)}, false
+	}
+	//签名只对本次调用有效,不再随属性向下游传递
+	delete(req.Properties, KEY_MOA_PROPERTY_TIMESTAMP)
+	delete(req.Properties, KEY_MOA_PROPERTY_SIGNATURE)
+	delete(req.Properties, KEY_MOA_PROPERTY_NONCE)
+	return caller, MoaRespPacket{}, true
+}
+
+//按照限流规则判断是否允许调用,拒绝则返回对应的响应
+func (self *Application) rateLimit(req MoaRawReqPacket) (MoaRespPacket, bool) {
+	uri, group := self.resolveService(req)
+	rule, ok := self.currentRateLimiter().Allow(req, uri, group)
+	if ok {
+		return MoaRespPacket{}, true
+	}
+	service, method := self.metricLabels(uri, group, req.Params.Method)
+	self.moaStat.IncrRateLimited(rule, service, method)
+	log.Warnf("Application|RateLimit|Reject|%s|Source:%s|%s|%s",
+		rule, req.Source, req.ServiceUri, req.Params.Method)
+	return MoaRespPacket{ErrCode: CODE_RATE_LIMITED,
+		Message: fmt.Sprintf(MSG_RATE_LIMITED, rule)}, false
+}
+
+//统计使用已经发布的服务和方法名,避免调用方传入任意的值导致指标的label无限增长
+func (self *Application) metricLabels(uri, group, method string) (string, string) {
+	if nil == self.invokeHandler {
+		return METRIC_LABEL_UNKNOWN, METRIC_LABEL_UNKNOWN
+	}
+	s, ok := self.invokeHandler.lookupService(uri, group)
+	if !ok {
+		return METRIC_LABEL_UNKNOWN, METRIC_LABEL_UNKNOWN
+	}
+	service := BuildServiceUri(s.ServiceUri, s.GroupId)
+	if m, ok := s.methods[strings.ToLower(method)]; ok {
+		return service, m.Name
+	}
+	return service, METRIC_LABEL_UNKNOWN
+}
+
+//计算请求的处理超时和截止时间,已经过期的请求返回false
+func (self *Application) prepareRequest(req *MoaRawReqPacket, now time.Time) (time.Time, bool) {
+	//服务和方法配置了超时则使用,否则为集群的ProcessTimeout
+	req.Timeout = self.invokeHandler.ProcessTimeout(
+		BuildServiceUri(requestServiceUri(req.ServiceUri, req.Properties)), req.Params.Method)
+	deadline := requestDeadline(*req, now)
+	if !now.Before(deadline) {
+		self.moaStat.IncrTimeout()
+		log.Warnf("InvocationHandler|Invoke|Timeout|Source:%s|Timeout[%d]ms|Deadline:%s|%s|%s",
+			req.Source, req.Timeout/time.Millisecond, req.Properties[KEY_MOA_PROPERTY_DEADLINE],
+			req.ServiceUri, req.Params.Method)
+		return deadline, false
+	}
+	//剩余的处理时间,嵌套调用继承剩余的时间
+	req.Timeout = deadline.Sub(now)
+	if nil == req.Properties {
+		req.Properties = make(map[string]string, 1)
+	}
+	req.Properties[KEY_MOA_PROPERTY_DEADLINE] = formatMoaDeadline(deadline)
+	return deadline, true
+}
+
+//请求的截止时间,服务端超时从请求创建开始计算,调用方带了截止时间则取更早的
+func requestDeadline(req MoaRawReqPacket, now time.Time) time.Time {
+	start := now
+	if req.CreateTime > 0 {
+		start = time.Unix(0, req.CreateTime*int64(time.Millisecond))
+	}
+	deadline := start.Add(req.Timeout)
+	if clientDeadline, ok := parseMoaDeadline(req.Properties[KEY_MOA_PROPERTY_DEADLINE]); ok &&
+		clientDeadline.Before(deadline) {
+		deadline = clientDeadline
+	}
+	return deadline
+}
+
 //处理Moa的状态信息
 func (self *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
@@ -351,7 +803,7 @@ func (self *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		} else if strings.HasPrefix(r.RequestURI, "/debug/moa/list/clients") {
 			//列出所有的客户端
-			clients := self.remoting.ListClients()
+			clients := self.listClients()
 			rawClients, _ := json.Marshal(clients)
 			w.WriteHeader(http.StatusOK)
 			w.Header().Set("Content-Type", "text/json")
@@ -360,7 +812,7 @@ func (self *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		} else if strings.HasPrefix(r.RequestURI, "/debug/moa/list/services") {
 			//列出所有的services
 			serviceNames := make([]string, 0, 1)
-			for serviceName := range self.invokeHandler.instances {
+			for serviceName := range self.invokeHandler.Services() {
 				serviceNames = append(serviceNames, serviceName)
 			}
 
@@ -369,6 +821,32 @@ func (self *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "text/json")
 			w.Write(rawServices)
 			return
+		} else if strings.HasPrefix(r.RequestURI, "/debug/moa/list/bulkheads") {
+			//列出所有的并发限制
+			rawBulkheads, _ := json.Marshal(self.invokeHandler.ListBulkheads())
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Content-Type", "text/json")
+			w.Write(rawBulkheads)
+			return
+		} else if strings.HasPrefix(r.RequestURI, "/debug/moa/list/denied") {
+			//列出访问控制拒绝的调用
+			rawDenied, _ := json.Marshal(self.denied.list())
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Content-Type", "text/json")
+			w.Write(rawDenied)
+			return
+		} else if strings.HasPrefix(r.RequestURI, "/debug/moa/cache/purge") {
+			//清除方法结果缓存 /debug/moa/cache/purge?service=user-profile&method=getProfile
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			purged := self.invokeHandler.PurgeCache(r.FormValue("service"), r.FormValue("method"))
+			rawPurged, _ := json.Marshal(map[string]int{"purged": purged})
+			w.WriteHeader(http.StatusOK)
+			w.Header().Set("Content-Type", "text/json")
+			w.Write(rawPurged)
+			return
 		} else if strings.HasPrefix(r.RequestURI, "/debug/moa/list/methods") {
 			//列出所有的方法 /moa/list/methods?serviceName=user-profile
 			serviceName := r.FormValue("service")
@@ -391,7 +869,7 @@ func (self *Application) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else if strings.HasPrefix(r.RequestURI, "/metrics") {
-		promhttp.Handler().ServeHTTP(w, r)
+		promhttp.HandlerFor(self.metrics, promhttp.HandlerOpts{}).ServeHTTP(w, r)
 	} else {
 		pprof.Index(w, r)
 	}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/google/gops/agent"
+)
+
+//admin server关闭等待时间
+const ADMIN_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+//admin的监听地址,没有配置则使用BindAddress的端口+1000
+func adminAddress(option Option) (string, error) {
+	if len(option.Admin.Address) > 0 {
+		return option.Admin.Address, nil
+	}
+	hp, err := net.ResolveTCPAddr("tcp4", option.Server.BindAddress)
+	if nil != err {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", hp.IP, hp.Port+1000), nil
+}
+
+//admin的路由,使用独立的ServeMux不污染http.DefaultServeMux
+func (self *Application) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, pro := range profiles {
+		mux.HandleFunc(pro.Href, self.ServeHTTP)
+	}
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	admin := self.currentOption().Admin
+	if len(admin.User) <= 0 {
+		return mux
+	}
+	//basic auth
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(admin.User)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(admin.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="moa-admin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+//启动admin server
+//包括 pprof、自定义moa状态信息、prometheus metrics
+func (self *Application) startAdmin() error {
+	option := self.currentOption()
+	if option.Admin.Disabled {
+		log.Infof("Application|Admin|Disabled")
+		return nil
+	}
+
+	address, err := adminAddress(option)
+	if nil != err {
+		return err
+	}
+	listener, err := net.Listen("tcp", address)
+	if nil != err {
+		return err
+	}
+
+	self.admin = &http.Server{Addr: address, Handler: self.adminHandler()}
+	go func() {
+		err := self.admin.Serve(listener)
+		if nil == err || err == http.ErrServerClosed {
+			return
+		}
+		log.Error(err)
+		if err := agent.Listen(agent.Options{ShutdownCleanup: true}); err != nil {
+			log.Errorf("Gops Start  FAIL %s ...", err)
+		}
+	}()
+	log.Infof("Application|Admin|Start|SUCC|%s", address)
+	return nil
+}
+
+//优雅关闭admin server
+func (self *Application) stopAdmin() {
+	if nil == self.admin {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ADMIN_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := self.admin.Shutdown(ctx); nil != err {
+		log.Warnf("Application|Admin|Shutdown|FAIL|%v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAddress(t *testing.T) {
+	var op Option
+	op.Server.BindAddress = "127.0.0.1:13000"
+	address, err := adminAddress(op)
+	if nil != err || address != "127.0.0.1:14000" {
+		t.Fatalf("default admin address %s|%v", address, err)
+	}
+
+	op.Admin.Address = "127.0.0.1:9090"
+	address, err = adminAddress(op)
+	if nil != err || address != "127.0.0.1:9090" {
+		t.Fatalf("admin address %s|%v", address, err)
+	}
+}
+
+func TestAdminHandlerBasicAuth(t *testing.T) {
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	op := testReloadOption()
+	op.Admin.User = "moa"
+	op.Admin.Password = "secret"
+	app, err := NewApplicationWithOption(context.TODO(), op, func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   demo,
+				Interface:  (*IHello)(nil)},
+		}
+	}, func(serviceUri, host string, moainfo MoaInfo) {})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		app.stop()
+		app.moaStat.Destroy()
+	}()
+
+	handler := app.adminHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/moa/list/services", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("request without auth should be rejected %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/debug/moa/list/services", nil)
+	r.SetBasicAuth("moa", "wrong")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("request with wrong password should be rejected %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/debug/moa/list/services", nil)
+	r.SetBasicAuth("moa", "secret")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `["/service/lookup"]` {
+		t.Fatalf("request with auth %d|%s", w.Code, w.Body.String())
+	}
+
+	//不在DefaultServeMux上注册
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/moa/stat", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("admin handlers should not be registered on DefaultServeMux %d", w.Code)
+	}
+}
+
+//同一进程中的多个Application使用独立的指标
+func TestAdminMetricsPerApplication(t *testing.T) {
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	newApp := func(bindAddress string) *Application {
+		op := testReloadOption()
+		op.Server.BindAddress = bindAddress
+		app, err := NewApplicationWithOption(context.TODO(), op, func() []Service {
+			return []Service{
+				Service{
+					ServiceUri: "/service/lookup",
+					Instance:   demo,
+					Interface:  (*IHello)(nil)},
+			}
+		}, func(serviceUri, host string, moainfo MoaInfo) {})
+		if nil != err {
+			t.Fatal(err)
+		}
+		return app
+	}
+	first := newApp("127.0.0.1:13021")
+	second := newApp("127.0.0.1:13022")
+	defer func() {
+		for _, app := range []*Application{first, second} {
+			app.stop()
+			app.moaStat.Destroy()
+		}
+	}()
+
+	first.moaStat.IncrRecv()
+	metrics := func(app *Application) string {
+		w := httptest.NewRecorder()
+		app.adminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("metrics %d", w.Code)
+		}
+		return w.Body.String()
+	}
+	if body := metrics(first); !strings.Contains(body, "moa_server_rpc_receive_total 1") {
+		t.Fatalf("first application metrics %s", body)
+	}
+	if body := metrics(second); !strings.Contains(body, "moa_server_rpc_receive_total 0") {
+		t.Fatalf("second application metrics %s", body)
+	}
+}
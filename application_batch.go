@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/blackbeans/turbo"
+)
+
+//单次批量调用的最大数量
+const MAX_BATCH_SIZE = 128
+
+//批量调用,每个调用在invokePool中并发执行
+//全部完成后按照请求的顺序返回一个响应,Result为每个调用的响应
+func (self *Application) dispatchBatch(client RemoteClient, p *turbo.Packet) {
+	batch := p.PayLoad.(MoaRawBatchReqPacket)
+	source := client.RemoteAddr()
+	option := self.currentOption()
+
+	//先计数再判断是否关闭，保证drain时不会漏掉刚进来的请求
+	atomic.AddInt64(&self.inflight, 1)
+	if self.isShutdown() {
+		atomic.AddInt64(&self.inflight, -1)
+		resp := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
+		resp.PayLoad = MoaRespPacket{ErrCode: CODE_SERVER_SHUTDOWN,
+			Message: fmt.Sprintf(MSG_SERVER_SHUTDOWN, option.Server.BindAddress)}
+		log.Warnf("Application|Shutdown|Reject|Batch|Source:%s|%d", source, len(batch.Requests))
+		client.Write(*resp)
+		return
+	}
+
+	if len(batch.Requests) <= 0 || len(batch.Requests) > MAX_BATCH_SIZE {
+		atomic.AddInt64(&self.inflight, -1)
+		resp := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
+		resp.PayLoad = MoaRespPacket{ErrCode: CODE_SERIALIZATION,
+			Message: fmt.Sprintf(MSG_BATCH_SIZE_INVALID, len(batch.Requests), MAX_BATCH_SIZE)}
+		log.Warnf("Application|Batch|Size Invalid|Source:%s|%d", source, len(batch.Requests))
+		client.Write(*resp)
+		return
+	}
+
+	//调用方可以通过CANCEL取消整个批量调用
+	callKey := invocationKey(source, p.Header.Opaque)
+	cancelCtx, userCancel := withUserCancel(self.ctx)
+	self.calls.Store(callKey, userCancel)
+
+	results := make([]MoaRespPacket, len(batch.Requests))
+	remaining := int32(len(batch.Requests))
+	//最后一个完成的调用写出响应
+	done := func(idx int, resp MoaRespPacket) {
+		results[idx] = resp
+		if atomic.AddInt32(&remaining, -1) > 0 {
+			return
+		}
+		defer func() {
+			userCancel.cancel()
+			self.calls.Delete(callKey)
+			atomic.AddInt64(&self.inflight, -1)
+		}()
+		//已经取消的调用不再写响应
+		if IsUserCancelled(cancelCtx) {
+			log.Infof("Application|Batch|Cancelled|Source:%s|%d", source, len(results))
+			return
+		}
+		respPacket := turbo.NewRespPacket(p.Header.Opaque, RESP, nil)
+		respPacket.PayLoad = MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: results}
+		if err := client.Write(*respPacket); nil != err {
+			log.Errorf("Application|Batch|Write|FAIL|%v|Source:%s|%d", err, source, len(results))
+		}
+	}
+
+	now := time.Now()
+	for i := range batch.Requests {
+		idx := i
+		req := batch.Requests[i]
+		req.Source = source
+		req.CreateTime = batch.CreateTime
+
+		if denied, ok := self.checkAccess(req); !ok {
+			done(idx, denied)
+			continue
+		}
+
+		caller, unauthorized, ok := self.authenticate(&req)
+		if !ok {
+			done(idx, unauthorized)
+			continue
+		}
+
+		//流式方法需要逐帧写出,批量调用中不支持
+		uri, group := requestServiceUri(req.ServiceUri, req.Properties)
+		if self.invokeHandler.isStream(uri, group, req.Params.Method) {
+			done(idx, MoaRespPacket{ErrCode: CODE_INVOCATION_TARGET,
+				Message: fmt.Sprintf(MSG_STREAM_IN_BATCH, req.Params.Method)})
+			continue
+		}
+
+		deadline, ok := self.prepareRequest(&req, now)
+		if !ok {
+			done(idx, MoaRespPacket{ErrCode: CODE_TIMEOUT_SERVER,
+				Message: fmt.Sprintf(MSG_TIMEOUT, req.ServiceUri)})
+			continue
+		}
+
+		if limited, ok := self.rateLimit(req); !ok {
+			done(idx, limited)
+			continue
+		}
+
+		timeoutCtx, cancel := context.WithDeadline(cancelCtx, deadline)
+		self.queueInvocation(timeoutCtx, func() {
+			defer cancel()
+			//设置当前的调用的属性线程上下文以及认证的调用方
+			invokeCtx := withMoaCaller(context.WithValue(timeoutCtx, KEY_MOA_PROPERTIES, req.Properties), caller)
+			resp, timeout := self.invokeHandler.call(invokeCtx, req)
+			if timeout {
+				resp = MoaRespPacket{ErrCode: CODE_TIMEOUT_SERVER,
+					Message: fmt.Sprintf(MSG_TIMEOUT, req.ServiceUri)}
+			}
+			done(idx, resp)
+		}, func(err error) {
+			//没有执行的调用也需要填充结果,否则整个批量调用不会响应
+			resp := MoaRespPacket{ErrCode: CODE_ASYNC_SUBMIT,
+				Message: fmt.Sprintf(MSG_INVOCATION_TARGET, err)}
+			if nil != timeoutCtx.Err() {
+				resp = MoaRespPacket{ErrCode: CODE_TIMEOUT_SERVER,
+					Message: fmt.Sprintf(MSG_TIMEOUT, req.ServiceUri)}
+			}
+			cancel()
+			log.Errorf("Application|Batch|Queue|FAIL|%v|Source:%s|%s|%s",
+				err, req.Source, req.ServiceUri, req.Params.Method)
+			done(idx, resp)
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/blackbeans/turbo"
+)
+
+//配置文件变更检查间隔
+const CONFIG_WATCH_INTERVAL = 5 * time.Second
+
+//注册中心访问控制的拉取间隔
+const ACL_REFRESH_INTERVAL = 5 * time.Second
+
+//监听配置文件的变更以及SIGHUP信号,重新加载配置
+func (self *Application) WatchConfiguration(configPath string) {
+	self.optionLock.Lock()
+	self.configPath = configPath
+	self.optionLock.Unlock()
+
+	modTime := configModTime(configPath)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(CONFIG_WATCH_INTERVAL)
+		defer func() {
+			ticker.Stop()
+			signal.Stop(hup)
+		}()
+		for {
+			select {
+			case <-self.ctx.Done():
+				return
+			case <-hup:
+				log.Infof("Application|WatchConfiguration|SIGHUP|%s", configPath)
+				if err := self.ReloadConfiguration(); nil != err {
+					log.Errorf("Application|WatchConfiguration|Reload|FAIL|%v|%s", err, configPath)
+				}
+			case <-ticker.C:
+				mt := configModTime(configPath)
+				if !mt.After(modTime) {
+					continue
+				}
+				modTime = mt
+				log.Infof("Application|WatchConfiguration|Changed|%s", configPath)
+				if err := self.ReloadConfiguration(); nil != err {
+					log.Errorf("Application|WatchConfiguration|Reload|FAIL|%v|%s", err, configPath)
+				}
+			}
+		}
+	}()
+}
+
+func configModTime(configPath string) time.Time {
+	fi, err := os.Stat(configPath)
+	if nil != err {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+//重新读取配置文件并生效
+func (self *Application) ReloadConfiguration() error {
+	self.optionLock.RLock()
+	configPath := self.configPath
+	self.optionLock.RUnlock()
+	if len(configPath) <= 0 {
+		return errors.New("Application|ReloadConfiguration|No Configuration File!")
+	}
+
+	option, err := LoadConfiguration(configPath)
+	if nil != err {
+		return err
+	}
+	return self.Reload(option)
+}
+
+//热更新配置
+//只有当前RunMode集群的ProcessTimeout、MaxDispatcherSize、SlowLogThreshold
+//Server.ShutdownTimeout、RateLimits、AccessControls以及Auth会在线生效,其他变更需要重启才能生效
+func (self *Application) Reload(option Option) error {
+	newOp, err := initServerOption(fillDefaults(option))
+	if nil != err {
+		return err
+	}
+	rateLimiter, err := newRateLimiter(newOp.RateLimits)
+	if nil != err {
+		return err
+	}
+	if _, err := newAccessList(newOp.AccessControls); nil != err {
+		return err
+	}
+	authenticator, err := newAuthenticator(newOp.Auth.Enabled, newOp.Auth.Keys, newOp.Auth.Window)
+	if nil != err {
+		return err
+	}
+
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	curr := self.currentOption()
+	newCluster, ok := newOp.Clusters[curr.Server.RunMode]
+	if !ok {
+		return fmt.Errorf("Application|Reload|RunMode Cluster Not Found|%s", curr.Server.RunMode)
+	}
+	currCluster := curr.Clusters[curr.Server.RunMode]
+
+	//需要重启才能生效的配置
+	for _, field := range restartRequiredFields(curr, newOp) {
+		log.Warnf("Application|Reload|NeedRestart|Ignored|%s", field)
+	}
+
+	next := curr
+	next.Server.ShutdownTimeout = newOp.Server.ShutdownTimeout
+	next.RateLimits = newOp.RateLimits
+	next.AccessControls = newOp.AccessControls
+	next.Auth = newOp.Auth
+	next.Clusters = make(map[string]Cluster, len(curr.Clusters))
+	for name, c := range curr.Clusters {
+		next.Clusters[name] = c
+	}
+	cluster := currCluster
+	cluster.ProcessTimeout = newCluster.ProcessTimeout
+	cluster.MaxDispatcherSize = newCluster.MaxDispatcherSize
+	cluster.SlowLogThreshold = newCluster.SlowLogThreshold
+	next.Clusters[curr.Server.RunMode] = cluster
+
+	//调用池大小变更则替换新的pool
+	var oldPool *turbo.GPool
+	self.optionLock.Lock()
+	self.options = next
+	authenticator.inherit(self.authenticator)
+	self.authenticator = authenticator
+	//规则没有变更则保留原有的令牌桶
+	if !reflect.DeepEqual(curr.RateLimits, next.RateLimits) {
+		self.rateLimiter = rateLimiter
+	}
+	if cluster.MaxDispatcherSize != currCluster.MaxDispatcherSize {
+		oldPool = self.invokePool
+		self.invokePool = turbo.NewLimitPool(self.ctx, cluster.MaxDispatcherSize)
+		self.moaStat.SetInvokePool(self.invokePool)
+	}
+	self.optionLock.Unlock()
+
+	if nil != oldPool {
+		//等待旧pool中已经提交的任务开始执行后再关闭
+		time.AfterFunc(cluster.ProcessTimeout, oldPool.Close)
+	}
+	self.invokeHandler.SetSlowLogThreshold(cluster.SlowLogThreshold)
+	self.invokeHandler.SetProcessTimeout(cluster.ProcessTimeout)
+	if err := self.reloadAccessControls(next.AccessControls); nil != err {
+		log.Errorf("Application|Reload|AccessControl|FAIL|%v", err)
+	}
+
+	log.Infof("Application|Reload|SUCC|ProcessTimeout:%s|MaxDispatcherSize:%d|SlowLogThreshold:%s|ShutdownTimeout:%s|RateLimits:%d",
+		cluster.ProcessTimeout, cluster.MaxDispatcherSize, cluster.SlowLogThreshold, next.Server.ShutdownTimeout,
+		len(next.RateLimits))
+	return nil
+}
+
+//对比出需要重启才能生效的配置项
+func restartRequiredFields(curr, next Option) []string {
+	fields := make([]string, 0, 2)
+	if curr.Server.RunMode != next.Server.RunMode {
+		fields = append(fields, "Server.RunMode")
+	}
+	if curr.Server.BindAddress != next.Server.BindAddress {
+		fields = append(fields, "Server.BindAddress")
+	}
+	if curr.Server.Compress != next.Server.Compress {
+		fields = append(fields, "Server.Compress")
+	}
+	if curr.Server.IsPre != next.Server.IsPre {
+		fields = append(fields, "Server.IsPre")
+	}
+	if strings.Join(curr.Server.Listeners, ",") != strings.Join(next.Server.Listeners, ",") {
+		fields = append(fields, "Server.Listeners")
+	}
+	if curr.Admin != next.Admin {
+		fields = append(fields, "Admin")
+	}
+
+	c := curr.Clusters[curr.Server.RunMode]
+	n, ok := next.Clusters[curr.Server.RunMode]
+	if !ok {
+		return fields
+	}
+	prefix := "Clusters." + curr.Server.RunMode + "."
+	if c.Registry != n.Registry {
+		fields = append(fields, prefix+"Registry")
+	}
+	if c.IdleTimeout != n.IdleTimeout {
+		fields = append(fields, prefix+"IdleTimeout")
+	}
+	if c.WorkerPoolSize != n.WorkerPoolSize {
+		fields = append(fields, prefix+"WorkerPoolSize")
+	}
+	if c.ReadBufferSize != n.ReadBufferSize {
+		fields = append(fields, prefix+"ReadBufferSize")
+	}
+	if c.WriteBufferSize != n.WriteBufferSize {
+		fields = append(fields, prefix+"WriteBufferSize")
+	}
+	if c.WriteChannelSize != n.WriteChannelSize {
+		fields = append(fields, prefix+"WriteChannelSize")
+	}
+	if c.ReadChannelSize != n.ReadChannelSize {
+		fields = append(fields, prefix+"ReadChannelSize")
+	}
+	if c.FutureSize != n.FutureSize {
+		fields = append(fields, prefix+"FutureSize")
+	}
+	return fields
+}
+
+//当前生效的配置
+func (self *Application) currentOption() Option {
+	self.optionLock.RLock()
+	defer self.optionLock.RUnlock()
+	return self.options
+}
+
+//当前的调用池
+func (self *Application) currentInvokePool() *turbo.GPool {
+	self.optionLock.RLock()
+	defer self.optionLock.RUnlock()
+	return self.invokePool
+}
+
+func (self *Application) currentAuthenticator() *Authenticator {
+	self.optionLock.RLock()
+	defer self.optionLock.RUnlock()
+	return self.authenticator
+}
+
+func (self *Application) currentAccessList() *AccessList {
+	self.optionLock.RLock()
+	defer self.optionLock.RUnlock()
+	return self.accessList
+}
+
+//重新拉取注册中心的访问控制
+func (self *Application) RefreshAccessControls() error {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+	return self.reloadAccessControls(self.currentOption().AccessControls)
+}
+
+//注册中心的访问控制没有变更通知,Start之后定时拉取直到Application关闭
+func (self *Application) watchAccessControls() {
+	go func() {
+		ticker := time.NewTicker(ACL_REFRESH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-self.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := self.RefreshAccessControls(); nil != err {
+					log.Errorf("Application|AccessControl|Refresh|FAIL|%v", err)
+				}
+			}
+		}
+	}()
+}
+
+//合并本地配置和注册中心下发的访问控制,需要持有reloadLock
+//注册中心的配置单独校验,不合法时继续使用上次的配置,本地配置始终生效
+func (self *Application) reloadAccessControls(local []AccessControl) error {
+	remote, err := self.configCenter.GetAccessControls()
+	if nil == err {
+		_, err = newAccessList(remote)
+	}
+	if nil != err {
+		//拉取失败或者不合法继续使用上次注册中心的配置
+		log.Errorf("Application|AccessControl|Registry|FAIL|%v", err)
+		self.optionLock.RLock()
+		remote = self.remoteAcls
+		self.optionLock.RUnlock()
+	}
+	acls := make([]AccessControl, 0, len(local)+len(remote))
+	acls = append(acls, local...)
+	acls = append(acls, remote...)
+	accessList, err := newAccessList(acls)
+	if nil != err {
+		return err
+	}
+	self.optionLock.Lock()
+	self.accessList = accessList
+	self.remoteAcls = remote
+	self.optionLock.Unlock()
+	return nil
+}
+
+func (self *Application) currentRateLimiter() *RateLimiter {
+	self.optionLock.RLock()
+	defer self.optionLock.RUnlock()
+	return self.rateLimiter
+}
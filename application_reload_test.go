@@ -0,0 +1,188 @@
+package core
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testReloadOption() Option {
+	var op Option
+	op.Server.RunMode = "dev"
+	op.Server.BindAddress = ":13002"
+	op.Clusters = map[string]Cluster{
+		"dev": Cluster{
+			Registry:          "file://./conf/cluster.yaml",
+			ProcessTimeout:    5 * time.Second,
+			MaxDispatcherSize: 10,
+		},
+	}
+	return op
+}
+
+func TestApplicationReload(t *testing.T) {
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	app, err := NewApplicationWithOption(context.TODO(), testReloadOption(), func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   demo,
+				Interface:  (*IHello)(nil)},
+		}
+	}, func(serviceUri, host string, moainfo MoaInfo) {})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		app.stop()
+		app.moaStat.Destroy()
+	}()
+
+	bindAddress := app.currentOption().Server.BindAddress
+	op := testReloadOption()
+	op.Server.BindAddress = ":13003"
+	cluster := op.Clusters["dev"]
+	cluster.ProcessTimeout = 200 * time.Millisecond
+	cluster.MaxDispatcherSize = 20
+	cluster.SlowLogThreshold = 100 * time.Millisecond
+	cluster.IdleTimeout = time.Second
+	op.Clusters["dev"] = cluster
+	op.RateLimits = []RateLimit{{Name: "lookup", Service: "/service/lookup", Rate: 1}}
+	op.AccessControls = []AccessControl{{Service: "/service/lookup", Deny: []string{"127.0.0.0/8"}}}
+	if err := app.Reload(op); nil != err {
+		t.Fatal(err)
+	}
+
+	curr := app.currentOption()
+	c := curr.Clusters["dev"]
+	if c.ProcessTimeout != 200*time.Millisecond {
+		t.Fatalf("ProcessTimeout not reloaded %s", c.ProcessTimeout)
+	}
+	if _, poolCap := app.currentInvokePool().Monitor(); poolCap != 20 {
+		t.Fatalf("InvokePool not resized %d", poolCap)
+	}
+	if time.Duration(app.invokeHandler.slowThreshold) != 100*time.Millisecond {
+		t.Fatalf("SlowLogThreshold not reloaded %d", app.invokeHandler.slowThreshold)
+	}
+	//限流规则热更新生效
+	limited := MoaRawReqPacket{ServiceUri: "/service/lookup", Source: "127.0.0.1:1000"}
+	limited.Params.Method = "GetService"
+	if _, ok := app.rateLimit(limited); !ok {
+		t.Fatal("first request should be allowed")
+	}
+	if resp, ok := app.rateLimit(limited); ok || resp.ErrCode != CODE_RATE_LIMITED {
+		t.Fatalf("request should be rate limited %v", resp)
+	}
+	//访问控制热更新生效
+	if resp, ok := app.checkAccess(limited); ok || resp.ErrCode != CODE_IP_NOT_ALLOWED {
+		t.Fatalf("request should be denied %v", resp)
+	}
+	if denied := app.denied.list(); len(denied) != 1 || denied[0].Source != "127.0.0.1" {
+		t.Fatalf("denied access not recorded %v", denied)
+	}
+	//需要重启的配置不生效
+	if curr.Server.BindAddress != bindAddress || c.IdleTimeout == time.Second {
+		t.Fatalf("restart required fields should be ignored %s|%s", curr.Server.BindAddress, c.IdleTimeout)
+	}
+
+	//不合法的配置不生效
+	op = testReloadOption()
+	op.Server.RunMode = "online"
+	if err := app.Reload(op); nil == err {
+		t.Fatal("invalid option should not be reloaded")
+	}
+	op.Server.RunMode = "dev"
+	op.RateLimits = []RateLimit{{Name: "invalid"}}
+	if err := app.Reload(op); nil == err {
+		t.Fatal("invalid rate limit should not be reloaded")
+	}
+	op.RateLimits = nil
+	op.AccessControls = []AccessControl{{Service: "/service/lookup", Allow: []string{"invalid"}}}
+	if err := app.Reload(op); nil == err {
+		t.Fatal("invalid access control should not be reloaded")
+	}
+	if app.currentOption().Clusters["dev"].ProcessTimeout != 200*time.Millisecond {
+		t.Fatal("invalid option should keep current option")
+	}
+}
+
+//注册中心下发的访问控制不合法时保留上次的配置,本地配置依然生效
+func TestReloadInvalidRemoteAccessControls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moa-acl")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cluster.yaml")
+	writeAcls := func(deny string) {
+		yaml := "acls:\n  - service_uri: \"/service/lookup\"\n    deny:\n      - \"" + deny + "\"\n"
+		if err := ioutil.WriteFile(path, []byte(yaml), 0644); nil != err {
+			t.Fatal(err)
+		}
+	}
+	writeAcls("10.0.0.1")
+
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	op := testReloadOption()
+	op.Clusters["dev"] = Cluster{Registry: "file://" + path}
+	app, err := NewApplicationWithOption(context.TODO(), op, func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   demo,
+				Interface:  (*IHello)(nil)},
+		}
+	}, func(serviceUri, host string, moainfo MoaInfo) {})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		app.stop()
+		app.moaStat.Destroy()
+	}()
+	allowed := func(source string) bool {
+		req := MoaRawReqPacket{ServiceUri: "/service/lookup", Source: source}
+		req.Params.Method = "GetService"
+		_, ok := app.checkAccess(req)
+		return ok
+	}
+	if allowed("10.0.0.1:1000") {
+		t.Fatal("request should be denied by registry acl")
+	}
+
+	writeAcls("invalid")
+	op.AccessControls = []AccessControl{{Service: "/service/lookup", Deny: []string{"127.0.0.0/8"}}}
+	if err := app.Reload(op); nil != err {
+		t.Fatal(err)
+	}
+	if allowed("127.0.0.1:1000") {
+		t.Fatal("local acl should be applied with invalid registry acls")
+	}
+	if allowed("10.0.0.1:1000") {
+		t.Fatal("last valid registry acl should be kept")
+	}
+	if !allowed("10.0.0.2:1000") {
+		t.Fatal("other source should be allowed")
+	}
+}
+
+func TestRestartRequiredFields(t *testing.T) {
+	curr := fillDefaults(testReloadOption())
+	next := fillDefaults(testReloadOption())
+	if fields := restartRequiredFields(curr, next); len(fields) != 0 {
+		t.Fatalf("no restart fields expected %v", fields)
+	}
+
+	next.Server.Compress = "none"
+	cluster := next.Clusters["dev"]
+	cluster.Registry = "zk://localhost:2181"
+	cluster.ProcessTimeout = time.Second
+	next.Clusters["dev"] = cluster
+	fields := restartRequiredFields(curr, next)
+	if len(fields) != 2 || fields[0] != "Server.Compress" || fields[1] != "Clusters.dev.Registry" {
+		t.Fatalf("unexpected restart fields %v", fields)
+	}
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blackbeans/turbo"
+)
+
+//逐帧写出流式方法的结果,每帧共享请求的opaque,最后写出结束帧
+//每写出一帧消耗一个credit,没有credits时等待调用方的STREAM_ACK
+func (self *Application) writeStream(ctx context.Context, client RemoteClient, opaque uint32,
+	req MoaRawReqPacket, stream *ResultStream) {
+	defer stream.close()
+	key := invocationKey(req.Source, opaque)
+	window := newStreamWindow(streamWindowSize(req.Properties))
+	self.streams.Store(key, window)
+	defer self.streams.Delete(key)
+
+	end := MoaRespPacket{ErrCode: CODE_SERVER_SUCC}
+	frames := 0
+	for {
+		err := window.acquire(ctx)
+		var result interface{}
+		ok := false
+		if nil == err {
+			result, ok, err = stream.next(ctx)
+		}
+		if nil != err {
+			//已经取消的调用不再写响应
+			if IsUserCancelled(ctx) {
+				log.Infof("Application|Stream|Cancelled|Source:%s|%s|%s|Frames:%d",
+					req.Source, req.ServiceUri, req.Params.Method, frames)
+				return
+			}
+			end = MoaRespPacket{ErrCode: CODE_TIMEOUT_SERVER,
+				Message: fmt.Sprintf(MSG_TIMEOUT, err)}
+			log.Warnf("Application|Stream|Abort|%v|Source:%s|%s|%s|Frames:%d",
+				err, req.Source, req.ServiceUri, req.Params.Method, frames)
+			break
+		}
+		if !ok {
+			break
+		}
+
+		frame := turbo.NewRespPacket(opaque, STREAM, nil)
+		frame.PayLoad = MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: result}
+		if err := client.Write(*frame); nil != err {
+			log.Errorf("Application|Stream|Write|FAIL|%v|Source:%s|%s|%s|Frames:%d",
+				err, req.Source, req.ServiceUri, req.Params.Method, frames)
+			return
+		}
+		frames++
+	}
+
+	frame := turbo.NewRespPacket(opaque, STREAM_END, nil)
+	frame.PayLoad = end
+	if err := client.Write(*frame); nil != err {
+		log.Errorf("Application|Stream|WriteEnd|FAIL|%v|Source:%s|%s|%s|Frames:%d",
+			err, req.Source, req.ServiceUri, req.Params.Method, frames)
+	}
+}
+
+//调用方确认消费,增加流控窗口
+func (self *Application) ackStream(source string, opaque uint32, credits int32) bool {
+	window, ok := self.streams.Load(invocationKey(source, opaque))
+	if !ok || credits <= 0 {
+		return false
+	}
+	window.(*streamWindow).release(credits)
+	return true
+}
@@ -0,0 +1,225 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/blackbeans/turbo"
+)
+
+type IStreamDemo interface {
+	Scan(ctx context.Context, count int) (<-chan int, error)
+}
+
+type StreamDemo struct {
+}
+
+func (self StreamDemo) Scan(ctx context.Context, count int) (<-chan int, error) {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for i := 0; i < count; i++ {
+			select {
+			case ch <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+//读取一个响应帧
+func readFrame(t *testing.T, conn net.Conn, timeout time.Duration) (*turbo.PacketHeader, *MoaRawRespPacket, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	head := make([]byte, turbo.PACKET_HEAD_LEN)
+	if _, err := io.ReadFull(conn, head); nil != err {
+		return nil, nil, err
+	}
+	header, err := turbo.UnmarshalHeader(bytes.NewReader(head))
+	if nil != err {
+		t.Fatal(err)
+	}
+	body := make([]byte, header.BodyLen)
+	if _, err := io.ReadFull(conn, body); nil != err {
+		t.Fatal(err)
+	}
+	resp, err := Wrap2MoaRawResponse(body)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return &header, resp, nil
+}
+
+//同步写出响应的调用方连接
+type testClient struct {
+	conn net.Conn
+}
+
+func (self testClient) RemoteAddr() string {
+	return self.conn.LocalAddr().String()
+}
+
+func (self testClient) Write(p turbo.Packet) error {
+	raw, err := BinaryCodec{MaxFrameLength: turbo.MAX_PACKET_BYTES}.MarshalPayload(&p)
+	if nil != err {
+		return err
+	}
+	p.Data = raw
+	_, err = self.conn.Write(p.Marshal())
+	return err
+}
+
+func (self testClient) Pong(opaque uint32, version int64) {}
+
+func TestWriteStream(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	//默认的严格模式不支持流式方法
+	_, err := newInvocationHandler([]Service{Service{ServiceUri: "stream",
+		Instance: StreamDemo{}, Interface: (*IStreamDemo)(nil)}}, stat)
+	if nil == err {
+		t.Fatal("stream method in strict mode should fail")
+	}
+
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "stream",
+		Instance: StreamDemo{}, Interface: (*IStreamDemo)(nil), Relaxed: true}}, stat)
+	app := &Application{invokeHandler: handler}
+
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn, err := ln.AcceptTCP()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	defer serverConn.Close()
+	client := testClient{conn: serverConn}
+
+	raw := MoaRawReqPacket{ServiceUri: "stream", Timeout: 5 * time.Second, Source: "127.0.0.1:1000",
+		Properties: map[string]string{KEY_MOA_PROPERTY_STREAM_WINDOW: "2"}}
+	raw.Params.Method = "Scan"
+	raw.Params.Args = []json.RawMessage{json.RawMessage("5")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go handler.Invoke(ctx, raw, func(resp MoaRespPacket) error {
+		stream, ok := resp.Result.(*ResultStream)
+		if !ok {
+			t.Errorf("TestWriteStream|Not Stream|%v", resp)
+			return nil
+		}
+		app.writeStream(ctx, client, 7, raw, stream)
+		return nil
+	})
+
+	//窗口为2
+	for i := 0; i < 2; i++ {
+		header, resp, err := readFrame(t, conn, 5*time.Second)
+		if nil != err || header.CmdType != STREAM || header.Opaque != 7 || string(resp.Result) != string(rune('0'+i)) {
+			t.Fatalf("TestWriteStream|Frame|%d|%v|%v", i, err, resp)
+		}
+	}
+	//没有credits不再写出
+	if _, _, err := readFrame(t, conn, 300*time.Millisecond); nil == err {
+		t.Fatal("TestWriteStream|Flow Control|frame should not be written without credits")
+	}
+
+	if !app.ackStream(raw.Source, 7, 10) {
+		t.Fatal("TestWriteStream|Ack|FAIL")
+	}
+	for i := 2; i < 5; i++ {
+		header, resp, err := readFrame(t, conn, 5*time.Second)
+		if nil != err || header.CmdType != STREAM || string(resp.Result) != string(rune('0'+i)) {
+			t.Fatalf("TestWriteStream|Frame|%d|%v|%v", i, err, resp)
+		}
+	}
+	header, resp, err := readFrame(t, conn, 5*time.Second)
+	if nil != err || header.CmdType != STREAM_END || resp.ErrCode != CODE_SERVER_SUCC {
+		t.Fatalf("TestWriteStream|End|%v|%v", err, resp)
+	}
+}
+
+//流式方法的并发限制在所有帧写完之后才释放
+func TestStreamBulkhead(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "stream",
+		Instance: StreamDemo{}, Interface: (*IStreamDemo)(nil), Relaxed: true,
+		MethodMaxConcurrency: map[string]int{"scan": 1}}}, stat)
+	app := &Application{invokeHandler: handler}
+
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn, err := ln.AcceptTCP()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	raw := MoaRawReqPacket{ServiceUri: "stream", Timeout: 5 * time.Second, Source: "127.0.0.1:1000"}
+	raw.Params.Method = "Scan"
+	raw.Params.Args = []json.RawMessage{json.RawMessage("3")}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	invoke := func() MoaRespPacket {
+		var result MoaRespPacket
+		handler.Invoke(ctx, raw, func(resp MoaRespPacket) error {
+			result = resp
+			return nil
+		})
+		return result
+	}
+
+	resp := invoke()
+	stream, ok := resp.Result.(*ResultStream)
+	if !ok {
+		t.Fatalf("TestStreamBulkhead|Not Stream|%v", resp)
+	}
+	//方法已经返回但是流还没有写出,仍然占用并发
+	if stats := handler.ListBulkheads(); len(stats) != 1 || stats[0].Current != 1 {
+		t.Fatalf("TestStreamBulkhead|Holding|%v", stats)
+	}
+	if resp := invoke(); resp.ErrCode != CODE_THREAD_POOL_IS_FULL {
+		t.Fatalf("TestStreamBulkhead|Reject|%v", resp)
+	}
+
+	app.writeStream(ctx, testClient{conn: serverConn}, 7, raw, stream)
+	for i := 0; i < 4; i++ {
+		if _, _, err := readFrame(t, conn, 5*time.Second); nil != err {
+			t.Fatalf("TestStreamBulkhead|Frame|%d|%v", i, err)
+		}
+	}
+	if stats := handler.ListBulkheads(); stats[0].Current != 0 {
+		t.Fatalf("TestStreamBulkhead|Released|%v", stats)
+	}
+	stream.close()
+	if stats := handler.ListBulkheads(); stats[0].Current != 0 {
+		t.Fatalf("TestStreamBulkhead|Released Once|%v", stats)
+	}
+	if resp := invoke(); resp.ErrCode != CODE_SERVER_SUCC {
+		t.Fatalf("TestStreamBulkhead|Next|%v", resp)
+	}
+}
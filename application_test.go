@@ -2,13 +2,16 @@ package core
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/blackbeans/logx"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/blackbeans/turbo"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type DemoResult struct {
@@ -179,9 +182,243 @@ func TestApplication(t *testing.T) {
 		t.Logf("%v\n", string(val.([]byte)))
 	}
 
+	//批量调用
+	batch := MoaBatchReqPacket{Requests: make([]MoaReqPacket, 2)}
+	batch.Requests[0].ServiceUri = "/service/lookup"
+	batch.Requests[0].Params.Method = "GetService"
+	batch.Requests[0].Params.Args = []interface{}{"fuck", "redis", "groupId"}
+	batch.Requests[1].ServiceUri = "/service/lookup"
+	batch.Requests[1].Params.Method = "NotExist"
+	batch.Requests[1].Params.Args = []interface{}{}
+	p = turbo.NewPacket(BATCH, nil)
+	p.PayLoad = batch
+	val, err = tclient.WriteAndGet(*p, 60*time.Second)
+	if nil != err {
+		t.Fatalf("WriteAndGet|BATCH|FAIL|%v", err)
+	}
+	batchResp, err := Wrap2MoaRawResponse(val.([]byte))
+	if nil != err || batchResp.ErrCode != CODE_SERVER_SUCC {
+		t.Fatalf("WriteAndGet|BATCH|FAIL|%v|%s", err, string(val.([]byte)))
+	}
+	var results []MoaRawRespPacket
+	json.Unmarshal(batchResp.Result, &results)
+	if len(results) != 2 || results[0].ErrCode != CODE_SERVER_SUCC || results[1].ErrCode != CODE_METHOD_NOT_FOUND {
+		t.Fatalf("WriteAndGet|BATCH|FAIL|%s", string(val.([]byte)))
+	}
+
 	time.Sleep(5 * time.Second)
 }
 
+func TestNewApplicationWithOptionErrors(t *testing.T) {
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	bundle := func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   demo,
+				Interface:  (*IHello)(nil)},
+		}
+	}
+	monitor := func(serviceUri, host string, moainfo MoaInfo) {}
+
+	newOption := func() Option {
+		var op Option
+		op.Server.RunMode = "dev"
+		op.Server.BindAddress = ":13001"
+		op.Clusters = map[string]Cluster{
+			"dev": Cluster{Registry: "file://./conf/cluster.yaml"},
+		}
+		return op
+	}
+
+	//RunMode对应的集群不存在
+	op := newOption()
+	op.Server.RunMode = "online"
+	if _, err := NewApplicationWithOption(context.TODO(), op, bundle, monitor); nil == err {
+		t.Fatal("missing RunMode cluster should return error")
+	}
+
+	//不支持的注册中心
+	op = newOption()
+	op.Clusters["dev"] = Cluster{Registry: "etcd://localhost:2379"}
+	if _, err := NewApplicationWithOption(context.TODO(), op, bundle, monitor); nil == err {
+		t.Fatal("unsupported registry should return error")
+	}
+
+	//没有发布服务
+	if _, err := NewApplicationWithOption(context.TODO(), newOption(), func() []Service { return nil }, monitor); nil == err {
+		t.Fatal("empty services should return error")
+	}
+
+	//没有实现接口
+	_, err := NewApplicationWithOption(context.TODO(), newOption(), func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   DemoProxy{},
+				Interface:  (*IHello)(nil)},
+		}
+	}, monitor)
+	if nil == err {
+		t.Fatal("instance not implements interface should return error")
+	}
+	t.Log(err)
+}
+
+//指标注册失败返回错误,已经注册的指标回滚
+func TestNewMoaStatRegisterError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	conflict := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "moa_server_invoke_max_pool",
+		Help: "The max cap of invoke pool",
+	})
+	reg.MustRegister(conflict)
+	newStat := func() (*MoaStat, error) {
+		return NewMoaStat("hostname", "serviceUri",
+			turbo.NewLimitPool(context.Background(), 100),
+			func(serviceUri, host string, moainfo MoaInfo) {},
+			func() map[string]turbo.NetworkStat { return map[string]turbo.NetworkStat{} },
+			reg)
+	}
+	_, err := newStat()
+	if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+		t.Fatalf("duplicate registration should return AlreadyRegisteredError %v", err)
+	}
+
+	reg.Unregister(conflict)
+	stat, err := newStat()
+	if nil != err {
+		t.Fatalf("collectors should be rolled back %v", err)
+	}
+	stat.Destroy()
+}
+
+func TestApplicationAddRemoveService(t *testing.T) {
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	var op Option
+	op.Server.RunMode = "dev"
+	op.Server.BindAddress = ":13001"
+	op.Clusters = map[string]Cluster{
+		"dev": Cluster{Registry: "file://./conf/cluster.yaml"},
+	}
+	app, err := NewApplicationWithOption(context.TODO(), op, func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   demo,
+				Interface:  (*IHello)(nil)},
+		}
+	}, func(serviceUri, host string, moainfo MoaInfo) {})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		app.stop()
+		app.moaStat.Destroy()
+	}()
+
+	err = app.AddService(Service{
+		ServiceUri: "/service/moa-admin",
+		Instance:   demo,
+		Interface:  (*IHello)(nil)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if s, ok := app.invokeHandler.getService("/service/moa-admin"); !ok || s.GroupId != "*" {
+		t.Fatalf("service not published %v", s)
+	}
+	if len(app.configCenter.services) != 2 {
+		t.Fatalf("service not added to config center %d", len(app.configCenter.services))
+	}
+
+	if err := app.RemoveService("/service/moa-admin"); nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := app.invokeHandler.getService("/service/moa-admin"); ok {
+		t.Fatal("service should be removed")
+	}
+	if err := app.RemoveService("/service/moa-admin"); nil == err {
+		t.Fatal("remove not exist service should fail")
+	}
+}
+
+func TestApplicationStartRollback(t *testing.T) {
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	var op Option
+	op.Server.RunMode = "dev"
+	op.Server.BindAddress = ":13011"
+	op.Server.Listeners = []string{"tcp://:13012"}
+	op.Admin.Disabled = true
+	op.Clusters = map[string]Cluster{
+		"dev": Cluster{Registry: "file://./conf/cluster.yaml"},
+	}
+	app, err := NewApplicationWithOption(context.TODO(), op, func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   demo,
+				Interface:  (*IHello)(nil)},
+		}
+	}, func(serviceUri, host string, moainfo MoaInfo) {})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	//额外的监听端口被占用,Start失败后全部回滚
+	occupied, err := net.Listen("tcp4", ":13012")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err := app.Start(); nil == err {
+		t.Fatal("start with occupied port should fail")
+	}
+	if atomic.LoadInt32(&app.started) != 0 {
+		t.Fatal("started should be reset after rollback")
+	}
+	if app.configCenter.published {
+		t.Fatal("services should not be published")
+	}
+	//主监听已经释放
+	l, err := net.Listen("tcp4", ":13011")
+	if nil != err {
+		t.Fatalf("listener not released %v", err)
+	}
+	l.Close()
+	occupied.Close()
+
+	//回滚之后可以重新Start,Stop不会重复关闭监听
+	if err := app.Start(); nil != err {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp4", "localhost:13012")
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+	app.Stop()
+	app.Stop()
+	for _, l := range app.listeners {
+		l.Shutdown()
+	}
+}
+
+func TestApplicationDrain(t *testing.T) {
+	app := &Application{}
+	atomic.AddInt64(&app.inflight, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt64(&app.inflight, -1)
+	}()
+	if !app.drain(2 * time.Second) {
+		t.Fatal("drain should finish after inflight invocation done")
+	}
+
+	atomic.AddInt64(&app.inflight, 1)
+	if app.drain(300 * time.Millisecond) {
+		t.Fatal("drain should timeout while invocation is still inflight")
+	}
+}
+
 func BenchmarkApplication(t *testing.B) {
 	t.StopTimer()
 	reqPacket := MoaReqPacket{}
@@ -204,3 +441,219 @@ func BenchmarkApplication(t *testing.B) {
 	}
 
 }
+
+func TestRequestDeadline(t *testing.T) {
+	now := time.Now()
+	req := MoaRawReqPacket{Timeout: 5 * time.Second,
+		CreateTime: now.Add(-time.Second).UnixNano() / int64(time.Millisecond)}
+
+	//没有调用方截止时间,从创建时间开始计算
+	deadline := requestDeadline(req, now)
+	if d := deadline.Sub(now); d > 4*time.Second+time.Millisecond || d < 4*time.Second-time.Millisecond {
+		t.Fatalf("server deadline %s", d)
+	}
+
+	//调用方的截止时间更早
+	req.Properties = map[string]string{KEY_MOA_PROPERTY_DEADLINE: formatMoaDeadline(now.Add(200 * time.Millisecond))}
+	if d := requestDeadline(req, now).Sub(now); d > 200*time.Millisecond || d < 199*time.Millisecond {
+		t.Fatalf("client deadline %s", d)
+	}
+
+	//调用方的截止时间更晚,使用服务端超时
+	req.Properties[KEY_MOA_PROPERTY_DEADLINE] = formatMoaDeadline(now.Add(time.Minute))
+	if !requestDeadline(req, now).Equal(deadline) {
+		t.Fatal("server deadline should win")
+	}
+
+	//调用方已经放弃
+	req.Properties[KEY_MOA_PROPERTY_DEADLINE] = formatMoaDeadline(now.Add(-time.Second))
+	if now.Before(requestDeadline(req, now)) {
+		t.Fatal("request should be expired")
+	}
+}
+
+type ISlow interface {
+	Wait(ctx context.Context, ms int) (string, error)
+}
+
+type Slow struct {
+	called *int32
+}
+
+func (self Slow) Wait(ctx context.Context, ms int) (string, error) {
+	atomic.AddInt32(self.called, 1)
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return "done", nil
+	}
+}
+
+func TestCancelInvocation(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	called := int32(0)
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil)}}, stat)
+	app := &Application{invokeHandler: handler}
+
+	raw := MoaRawReqPacket{ServiceUri: "slow", Timeout: 5 * time.Second, Source: "127.0.0.1:1000"}
+	raw.Params.Method = "Wait"
+	raw.Params.Args = []json.RawMessage{json.RawMessage("5000")}
+
+	//执行中被取消
+	ctx, uc := withUserCancel(context.TODO())
+	app.calls.Store(invocationKey(raw.Source, 1), uc)
+	time.AfterFunc(100*time.Millisecond, func() {
+		if !app.cancelInvocation(raw.Source, 1) {
+			t.Errorf("TestCancelInvocation|cancel fail")
+		}
+	})
+	now := time.Now()
+	handler.Invoke(ctx, raw, func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_USER_CANCELLED {
+			t.Errorf("TestCancelInvocation|Running|%v", resp)
+		}
+		return nil
+	})
+	if cost := time.Since(now); cost >= time.Second {
+		t.Fatalf("TestCancelInvocation|not cancelled|%s", cost)
+	}
+
+	//执行前被取消则不再执行
+	ctx, uc = withUserCancel(context.TODO())
+	uc.Cancel()
+	handler.Invoke(ctx, raw, func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_USER_CANCELLED {
+			t.Errorf("TestCancelInvocation|Before|%v", resp)
+		}
+		return nil
+	})
+	if atomic.LoadInt32(&called) != 1 {
+		t.Fatalf("TestCancelInvocation|called %d", called)
+	}
+
+	if app.cancelInvocation(raw.Source, 2) {
+		t.Fatal("cancel not exist invocation should fail")
+	}
+}
+
+func TestQueueInvocationSkipped(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	called := int32(0)
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil)}}, stat)
+	ctx, stop := context.WithCancel(context.TODO())
+	app := &Application{invokeHandler: handler, moaStat: stat,
+		invokePool: turbo.NewLimitPool(context.TODO(), 10), ctx: ctx, stop: stop}
+
+	//调用在worker执行前ctx已经结束,invokePool会直接丢弃
+	stop()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := testClient{conn: conn}
+	for i := 0; i < 100; i++ {
+		raw := MoaRawReqPacket{ServiceUri: "slow", Timeout: 5 * time.Second}
+		raw.Params.Method = "Wait"
+		raw.Params.Args = []json.RawMessage{json.RawMessage("10")}
+		p := turbo.NewPacket(REQ, nil)
+		p.Header.Opaque = uint32(i)
+		p.PayLoad = raw
+		dis(app, client, p, nil)
+	}
+
+	//inflight和进行中的调用都需要释放,不能等到drain超时
+	if !app.drain(time.Second) {
+		t.Fatalf("inflight leaked %d", atomic.LoadInt64(&app.inflight))
+	}
+	app.calls.Range(func(key, value interface{}) bool {
+		t.Fatalf("call leaked %v", key)
+		return true
+	})
+	if atomic.LoadInt32(&called) != 0 {
+		t.Fatalf("cancelled invocation should not be called %d", called)
+	}
+
+	//run和skip只执行一次
+	runs, skips := int32(0), int32(0)
+	for i := 0; i < 100; i++ {
+		app.queueInvocation(ctx, func() {
+			atomic.AddInt32(&runs, 1)
+		}, func(err error) {
+			atomic.AddInt32(&skips, 1)
+		})
+	}
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != 0 || atomic.LoadInt32(&skips) != 100 {
+		t.Fatalf("run %d skip %d", runs, skips)
+	}
+}
+
+func TestDispatchBatchSkipped(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	called := int32(0)
+	handler := NewInvocationHandler([]Service{
+		Service{ServiceUri: "slow", Instance: Slow{called: &called}, Interface: (*ISlow)(nil)},
+		Service{ServiceUri: "stream", Instance: StreamDemo{}, Interface: (*IStreamDemo)(nil), Relaxed: true}}, stat)
+	ctx, stop := context.WithCancel(context.TODO())
+	app := &Application{invokeHandler: handler, moaStat: stat,
+		invokePool: turbo.NewLimitPool(context.TODO(), 10), ctx: ctx, stop: stop}
+
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn, err := ln.AcceptTCP()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	batch := MoaRawBatchReqPacket{Requests: make([]MoaRawReqPacket, 2)}
+	batch.Requests[0] = MoaRawReqPacket{ServiceUri: "slow", Timeout: 5 * time.Second}
+	batch.Requests[0].Params.Method = "Wait"
+	batch.Requests[0].Params.Args = []json.RawMessage{json.RawMessage("10")}
+	batch.Requests[1] = MoaRawReqPacket{ServiceUri: "stream", Timeout: 5 * time.Second}
+	batch.Requests[1].Params.Method = "Scan"
+	batch.Requests[1].Params.Args = []json.RawMessage{json.RawMessage("5")}
+
+	//调用在worker执行前ctx已经结束,依然需要返回批量调用的响应
+	stop()
+	p := turbo.NewPacket(BATCH, nil)
+	p.Header.Opaque = 9
+	p.PayLoad = batch
+	dis(app, testClient{conn: serverConn}, p, nil)
+
+	header, resp, err := readFrame(t, conn, 5*time.Second)
+	if nil != err || header.Opaque != 9 || resp.ErrCode != CODE_SERVER_SUCC {
+		t.Fatalf("batch response %v|%v", err, resp)
+	}
+	var results []MoaRawRespPacket
+	json.Unmarshal(resp.Result, &results)
+	if len(results) != 2 || results[0].ErrCode != CODE_TIMEOUT_SERVER || results[1].ErrCode != CODE_INVOCATION_TARGET {
+		t.Fatalf("batch results %s", string(resp.Result))
+	}
+	if !app.drain(time.Second) {
+		t.Fatalf("inflight leaked %d", atomic.LoadInt64(&app.inflight))
+	}
+	if _, ok := app.calls.Load(invocationKey(serverConn.LocalAddr().String(), 9)); ok {
+		t.Fatal("batch call leaked")
+	}
+}
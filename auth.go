@@ -0,0 +1,178 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//签名时间戳允许的默认偏差
+const DEFAULT_AUTH_WINDOW = 5 * time.Minute
+
+//每个app在重放记录中最多保留的签名数,超过后拒绝新的签名,避免重放记录无限增长
+const MAX_REPLAY_SIGNATURES = 100000
+
+//调用方认证
+//调用方在属性中带上moa.app、moa.timestamp(unix ms)、moa.nonce以及moa.signature
+//签名为 hex(HMAC-SHA256(key, app\ntimestamp\nnonce\nserviceUri\ngroupId\nmethod\nhex(SHA256(规范化的args)))),
+//时间窗口内同一个签名只能使用一次
+type Authenticator struct {
+	keys    map[string]string
+	window  time.Duration
+	replays *replayCache
+}
+
+//没有开启认证返回nil
+func newAuthenticator(enabled bool, keys map[string]string, window time.Duration) (*Authenticator, error) {
+	if !enabled {
+		return nil, nil
+	}
+	if len(keys) <= 0 {
+		return nil, errors.New("Auth Keys Empty!")
+	}
+	if window <= 0 {
+		window = DEFAULT_AUTH_WINDOW
+	}
+	copied := make(map[string]string, len(keys))
+	for app, key := range keys {
+		if len(key) <= 0 {
+			return nil, fmt.Errorf("Auth Key Empty! [%s]", app)
+		}
+		copied[app] = key
+	}
+	return &Authenticator{keys: copied, window: window, replays: newReplayCache(window)}, nil
+}
+
+//调用的签名,serviceUri和groupId为action以及moa.group属性解析后的服务和分组
+func MoaSignature(key, app string, timestamp int64, nonce, serviceUri, groupId, method string,
+	args []json.RawMessage) string {
+	digest := sha256.Sum256([]byte(canonicalArgs(args)))
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join([]string{app, strconv.FormatInt(timestamp, 10), nonce,
+		serviceUri, groupId, method, hex.EncodeToString(digest[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//给调用签名,签名信息写入属性,需要在设置moa.group等属性之后调用
+func SignMoaProperties(props map[string]string, key, app, action, method string, args []json.RawMessage,
+	now time.Time) {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	props[KEY_MOA_PROPERTY_APP] = app
+	props[KEY_MOA_PROPERTY_TIMESTAMP] = strconv.FormatInt(timestamp, 10)
+	props[KEY_MOA_PROPERTY_NONCE] = hex.EncodeToString(nonce)
+	uri, group := requestServiceUri(action, props)
+	props[KEY_MOA_PROPERTY_SIGNATURE] = MoaSignature(key, app, timestamp, props[KEY_MOA_PROPERTY_NONCE],
+		uri, group, method, args)
+}
+
+//校验调用方的签名,成功返回调用方的app
+func (self *Authenticator) Authenticate(req MoaRawReqPacket, now time.Time) (string, error) {
+	app := req.Properties[KEY_MOA_PROPERTY_APP]
+	if len(app) <= 0 {
+		return "", errors.New("app missing")
+	}
+	key, ok := self.keys[app]
+	if !ok {
+		return app, errors.New("app unknown")
+	}
+
+	timestamp, err := strconv.ParseInt(req.Properties[KEY_MOA_PROPERTY_TIMESTAMP], 10, 64)
+	if nil != err {
+		return app, errors.New("timestamp invalid")
+	}
+	//超出时间窗口的请求视为重放
+	skew := now.Sub(time.Unix(0, timestamp*int64(time.Millisecond)))
+	if skew > self.window || skew < -self.window {
+		return app, errors.New("timestamp expired")
+	}
+
+	nonce := req.Properties[KEY_MOA_PROPERTY_NONCE]
+	if len(nonce) <= 0 {
+		return app, errors.New("nonce missing")
+	}
+
+	signature, err := hex.DecodeString(req.Properties[KEY_MOA_PROPERTY_SIGNATURE])
+	if nil != err || len(signature) <= 0 {
+		return app, errors.New("signature invalid")
+	}
+	uri, group := requestServiceUri(req.ServiceUri, req.Properties)
+	expected, _ := hex.DecodeString(MoaSignature(key, app, timestamp, nonce, uri, group,
+		req.Params.Method, req.Params.Args))
+	if !hmac.Equal(signature, expected) {
+		return app, errors.New("signature mismatch")
+	}
+	//签名校验通过之后才记录,避免伪造的签名占用缓存
+	if err := self.replays.record(app, req.Properties[KEY_MOA_PROPERTY_SIGNATURE], now); nil != err {
+		return app, err
+	}
+	return app, nil
+}
+
+//热更新时时间窗口没有变更则继续使用原有的重放记录
+func (self *Authenticator) inherit(prev *Authenticator) {
+	if nil == self || nil == prev || self.window != prev.window {
+		return
+	}
+	self.replays = prev.replays
+}
+
+//已经使用过的签名
+//签名在时间戳前后各一个window内有效,两代记录按照2*window轮换,保证有效期内的签名不会被遗忘
+type replayCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	limit   int
+	rotated time.Time
+	curr    map[string]struct{}
+	prev    map[string]struct{}
+	//每个app在两代记录中的签名数
+	currCounts map[string]int
+	prevCounts map[string]int
+}
+
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		ttl:        2 * window,
+		limit:      MAX_REPLAY_SIGNATURES,
+		curr:       make(map[string]struct{}, 1024),
+		prev:       make(map[string]struct{}),
+		currCounts: make(map[string]int),
+		prevCounts: make(map[string]int)}
+}
+
+//记录app的签名,已经使用过或者app的签名数超过限制时返回错误
+func (self *replayCache) record(app, signature string, now time.Time) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.rotated.IsZero() {
+		self.rotated = now
+	} else if now.Sub(self.rotated) >= self.ttl {
+		self.prev, self.curr = self.curr, make(map[string]struct{}, len(self.curr))
+		self.prevCounts, self.currCounts = self.currCounts, make(map[string]int, len(self.currCounts))
+		self.rotated = now
+	}
+	key := app + "|" + signature
+	if _, ok := self.curr[key]; ok {
+		return errors.New("signature replayed")
+	}
+	if _, ok := self.prev[key]; ok {
+		return errors.New("signature replayed")
+	}
+	//超过限制时拒绝而不是淘汰旧的签名,淘汰的签名在有效期内可以被重放
+	if self.currCounts[app]+self.prevCounts[app] >= self.limit {
+		return errors.New("too many signatures")
+	}
+	self.curr[key] = struct{}{}
+	self.currCounts[app]++
+	return nil
+}
@@ -0,0 +1,204 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthenticator(t *testing.T) {
+	if auth, err := newAuthenticator(false, nil, 0); nil != err || nil != auth {
+		t.Fatalf("disabled authenticator should be nil %v %v", auth, err)
+	}
+	if _, err := newAuthenticator(true, nil, 0); nil == err {
+		t.Fatal("empty keys should fail")
+	}
+
+	auth, err := newAuthenticator(true, map[string]string{"app1": "secret1"}, time.Minute)
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	signed := func(key, app string, at time.Time) MoaRawReqPacket {
+		req := MoaRawReqPacket{ServiceUri: "/service/lookup", Properties: map[string]string{}}
+		req.Params.Method = "GetService"
+		req.Params.Args = []json.RawMessage{json.RawMessage(`"/service/lookup"`), json.RawMessage(`{"a":1,"b":2}`)}
+		SignMoaProperties(req.Properties, key, app, req.ServiceUri, req.Params.Method, req.Params.Args, at)
+		return req
+	}
+
+	if caller, err := auth.Authenticate(signed("secret1", "app1", now), now); nil != err || caller != "app1" {
+		t.Fatalf("signed request should pass %s %v", caller, err)
+	}
+
+	req := signed("secret1", "app1", now)
+	req.Params.Method = "SetName"
+	if _, err := auth.Authenticate(req, now); nil == err {
+		t.Fatal("signature of other method should fail")
+	}
+	if _, err := auth.Authenticate(signed("secret2", "app1", now), now); nil == err {
+		t.Fatal("wrong key should fail")
+	}
+	if _, err := auth.Authenticate(signed("secret1", "app2", now), now); nil == err {
+		t.Fatal("unknown app should fail")
+	}
+	//时间窗口外的请求视为重放
+	if _, err := auth.Authenticate(signed("secret1", "app1", now.Add(-2*time.Minute)), now); nil == err {
+		t.Fatal("expired request should fail")
+	}
+	if _, err := auth.Authenticate(signed("secret1", "app1", now.Add(2*time.Minute)), now); nil == err {
+		t.Fatal("future request should fail")
+	}
+
+	//参数只忽略空白和字段顺序
+	req = signed("secret1", "app1", now)
+	req.Params.Args[1] = json.RawMessage(`{ "b":2, "a":1 }`)
+	if _, err := auth.Authenticate(req, now); nil != err {
+		t.Fatalf("reformatted args should pass %v", err)
+	}
+	req = signed("secret1", "app1", now)
+	req.Params.Args[0] = json.RawMessage(`"/service/other"`)
+	if _, err := auth.Authenticate(req, now); nil == err {
+		t.Fatal("tampered args should fail")
+	}
+	req = signed("secret1", "app1", now)
+	req.Properties[KEY_MOA_PROPERTY_GROUP] = "g1"
+	if _, err := auth.Authenticate(req, now); nil == err {
+		t.Fatal("tampered group should fail")
+	}
+	req = signed("secret1", "app1", now)
+	delete(req.Properties, KEY_MOA_PROPERTY_NONCE)
+	if _, err := auth.Authenticate(req, now); nil == err {
+		t.Fatal("missing nonce should fail")
+	}
+
+	//同一个签名只能使用一次
+	req = signed("secret1", "app1", now)
+	if _, err := auth.Authenticate(req, now); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(req, now.Add(30*time.Second)); nil == err {
+		t.Fatal("replayed request should fail")
+	}
+	//重放记录跨过轮换仍然有效
+	if _, err := auth.Authenticate(signed("secret1", "app1", now.Add(2*time.Minute)), now.Add(2*time.Minute)); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := auth.Authenticate(req, now.Add(59*time.Second)); nil == err {
+		t.Fatal("replayed request after rotation should fail")
+	}
+
+	req = signed("secret1", "app1", now)
+	delete(req.Properties, KEY_MOA_PROPERTY_SIGNATURE)
+	if _, err := auth.Authenticate(req, now); nil == err {
+		t.Fatal("missing signature should fail")
+	}
+	req = signed("secret1", "app1", now)
+	req.Properties[KEY_MOA_PROPERTY_TIMESTAMP] = strconv.FormatInt(now.UnixNano()/int64(time.Millisecond)+1, 10)
+	if _, err := auth.Authenticate(req, now); nil == err {
+		t.Fatal("tampered timestamp should fail")
+	}
+}
+
+func TestApplicationAuthenticate(t *testing.T) {
+	op := testReloadOption()
+	op.Auth.Enabled = true
+	op.Auth.Keys = map[string]string{"app1": "secret1"}
+	app, err := NewApplicationWithOption(context.TODO(), op, func() []Service {
+		return []Service{
+			Service{
+				ServiceUri: "/service/lookup",
+				Instance:   Demo{make(map[string][]string, 2), "/service/lookup"},
+				Interface:  (*IHello)(nil)},
+		}
+	}, func(serviceUri, host string, moainfo MoaInfo) {})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		app.stop()
+		app.moaStat.Destroy()
+	}()
+
+	req := MoaRawReqPacket{ServiceUri: "/service/lookup", Source: "127.0.0.1:1000",
+		Properties: map[string]string{KEY_MOA_PROPERTY_APP: "app1"}}
+	req.Params.Method = "GetService"
+	if _, resp, ok := app.authenticate(&req); ok || resp.ErrCode != CODE_AUTH_FAILED {
+		t.Fatalf("unsigned request should be rejected %v", resp)
+	}
+
+	SignMoaProperties(req.Properties, "secret1", "app1", req.ServiceUri, req.Params.Method, req.Params.Args, time.Now())
+	replayed := req
+	replayed.Properties = make(map[string]string, len(req.Properties))
+	for k, v := range req.Properties {
+		replayed.Properties[k] = v
+	}
+	caller, _, ok := app.authenticate(&req)
+	if !ok || caller != "app1" {
+		t.Fatalf("signed request should pass %s", caller)
+	}
+	//签名不再向下游传递
+	if _, ok := req.Properties[KEY_MOA_PROPERTY_SIGNATURE]; ok {
+		t.Fatal("signature should be removed")
+	}
+	ctx := withMoaCaller(context.WithValue(context.TODO(), KEY_MOA_PROPERTIES, req.Properties), caller)
+	if c, ok := GetMoaCaller(ctx); !ok || c != "app1" {
+		t.Fatalf("caller not found in context %s", c)
+	}
+	if _, ok := GetMoaCaller(context.TODO()); ok {
+		t.Fatal("caller should not exist without authentication")
+	}
+
+	//热更新之后重放仍然被拒绝
+	if err := app.Reload(op); nil != err {
+		t.Fatal(err)
+	}
+	if _, resp, ok := app.authenticate(&replayed); ok || resp.ErrCode != CODE_AUTH_FAILED {
+		t.Fatalf("replayed request should be rejected %v", resp)
+	}
+
+	//关闭认证热更新生效
+	if err := app.Reload(testReloadOption()); nil != err {
+		t.Fatal(err)
+	}
+	if caller, _, ok := app.authenticate(&req); !ok || len(caller) > 0 {
+		t.Fatalf("authentication should be disabled %s", caller)
+	}
+}
+
+//每个app的重放记录超过限制时拒绝新的签名,轮换后恢复
+func TestReplayCacheLimit(t *testing.T) {
+	replays := newReplayCache(time.Minute)
+	replays.limit = 2
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := replays.record("app1", strconv.Itoa(i), now); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err := replays.record("app1", "2", now); nil == err {
+		t.Fatal("signature over limit should be rejected")
+	}
+	//已经记录的签名依然判断为重放
+	if err := replays.record("app1", "0", now); nil == err || err.Error() != "signature replayed" {
+		t.Fatalf("recorded signature should be replayed %v", err)
+	}
+	//其他app不受影响
+	if err := replays.record("app2", "2", now); nil != err {
+		t.Fatal(err)
+	}
+	if len(replays.curr) != 3 {
+		t.Fatalf("rejected signature should not be recorded %d", len(replays.curr))
+	}
+
+	//上一代的签名同样计数
+	if err := replays.record("app1", "2", now.Add(2*time.Minute)); nil == err {
+		t.Fatal("signatures of previous generation should be counted")
+	}
+	//两代都轮换出去之后可以继续记录
+	if err := replays.record("app1", "2", now.Add(4*time.Minute)); nil != err {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+//并发限制,超过限制的请求直接拒绝,避免慢方法占满调用池
+type Bulkhead struct {
+	limit   int32
+	current int32
+}
+
+//limit<=0为不限制
+func newBulkhead(limit int) *Bulkhead {
+	if limit <= 0 {
+		return nil
+	}
+	return &Bulkhead{limit: int32(limit)}
+}
+
+func (self *Bulkhead) acquire() bool {
+	if nil == self {
+		return true
+	}
+	if atomic.AddInt32(&self.current, 1) > self.limit {
+		atomic.AddInt32(&self.current, -1)
+		return false
+	}
+	return true
+}
+
+func (self *Bulkhead) release() {
+	if nil != self {
+		atomic.AddInt32(&self.current, -1)
+	}
+}
+
+func (self *Bulkhead) Current() int32 {
+	if nil == self {
+		return 0
+	}
+	return atomic.LoadInt32(&self.current)
+}
+
+func (self *Bulkhead) Limit() int32 {
+	if nil == self {
+		return 0
+	}
+	return self.limit
+}
+
+//并发限制的状态
+type BulkheadStat struct {
+	Service string `json:"service"`
+	//服务级别的为*
+	Method  string `json:"method"`
+	Current int32  `json:"current"`
+	Limit   int32  `json:"limit"`
+}
+
+//所有配置了并发限制的服务和方法
+func (self *InvocationHandler) ListBulkheads() []BulkheadStat {
+	stats := make([]BulkheadStat, 0, 10)
+	for key, s := range self.Services() {
+		if nil != s.bulkhead {
+			stats = append(stats, BulkheadStat{Service: key, Method: "*",
+				Current: s.bulkhead.Current(), Limit: s.bulkhead.Limit()})
+		}
+		for _, m := range s.methods {
+			if nil != m.bulkhead {
+				stats = append(stats, BulkheadStat{Service: key, Method: m.Name,
+					Current: m.bulkhead.Current(), Limit: m.bulkhead.Limit()})
+			}
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Service != stats[j].Service {
+			return stats[i].Service < stats[j].Service
+		}
+		return stats[i].Method < stats[j].Method
+	})
+	return stats
+}
+
+//服务和方法的并发限制,先获取服务的再获取方法的
+func (self *InvocationHandler) bulkheadInterceptor(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+	s, ok := self.lookupService(invocation.ServiceUri, invocation.GroupId)
+	if !ok {
+		return next(ctx, invocation)
+	}
+	key := BuildServiceUri(s.ServiceUri, s.GroupId)
+	m := s.methods[strings.ToLower(invocation.Method)]
+
+	if !s.bulkhead.acquire() {
+		return self.rejectBulkhead(invocation, key, "*", s.bulkhead)
+	}
+	if !m.bulkhead.acquire() {
+		s.bulkhead.release()
+		return self.rejectBulkhead(invocation, key, m.Name, m.bulkhead)
+	}
+	self.observeBulkhead(key, "*", s.bulkhead)
+	self.observeBulkhead(key, m.Name, m.bulkhead)
+	release := func() {
+		m.bulkhead.release()
+		s.bulkhead.release()
+		self.observeBulkhead(key, "*", s.bulkhead)
+		self.observeBulkhead(key, m.Name, m.bulkhead)
+	}
+
+	streaming := false
+	defer func() {
+		if !streaming {
+			release()
+		}
+	}()
+	resp := next(ctx, invocation)
+	//流式方法在所有帧写完之后才释放
+	if stream, ok := resp.Result.(*ResultStream); ok {
+		stream.onClose(release)
+		streaming = true
+	}
+	return resp
+}
+
+func (self *InvocationHandler) rejectBulkhead(invocation *Invocation, service, method string, bulkhead *Bulkhead) MoaRespPacket {
+	log.Warnf("InvocationHandler|Bulkhead|Reject|Source:%s|%s|%s|%d/%d",
+		invocation.Source, service, method, bulkhead.Current(), bulkhead.Limit())
+	return MoaRespPacket{ErrCode: CODE_THREAD_POOL_IS_FULL,
+		Message: fmt.Sprintf(MSG_THREAD_POOL_IS_FULL, fmt.Sprintf("%s|%s %d/%d",
+			service, method, bulkhead.Current(), bulkhead.Limit()))}
+}
+
+//并发数写入prometheus
+func (self *InvocationHandler) observeBulkhead(service, method string, bulkhead *Bulkhead) {
+	if nil == bulkhead || nil == self.moaStat {
+		return
+	}
+	metrics := self.moaStat.MoaMetrics
+	metrics.BulkheadInuseGauge.WithLabelValues(service, method).Set(float64(bulkhead.Current()))
+	metrics.BulkheadLimitGauge.WithLabelValues(service, method).Set(float64(bulkhead.Limit()))
+}
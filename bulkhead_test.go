@@ -0,0 +1,70 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBulkhead(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	called := int32(0)
+
+	_, err := newInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+		MethodMaxConcurrency: map[string]int{"NotExist": 1}}}, stat)
+	if nil == err {
+		t.Fatal("max concurrency of not exist method should fail")
+	}
+
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+		MaxConcurrency:       2,
+		MethodMaxConcurrency: map[string]int{"wait": 1}}}, stat)
+
+	invoke := func(ms int) MoaRespPacket {
+		raw := MoaRawReqPacket{ServiceUri: "slow", Timeout: 5 * time.Second, Source: "127.0.0.1:1000"}
+		raw.Params.Method = "Wait"
+		raw.Params.Args = []json.RawMessage{json.RawMessage(fmt.Sprintf("%d", ms))}
+		var result MoaRespPacket
+		handler.Invoke(context.TODO(), raw, func(resp MoaRespPacket) error {
+			result = resp
+			return nil
+		})
+		return result
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if resp := invoke(300); resp.ErrCode != CODE_SERVER_SUCC {
+			t.Errorf("TestBulkhead|First|%v", resp)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	//方法的并发已经满了
+	if resp := invoke(0); resp.ErrCode != CODE_THREAD_POOL_IS_FULL {
+		t.Fatalf("TestBulkhead|Reject|%v", resp)
+	}
+	stats := handler.ListBulkheads()
+	if len(stats) != 2 || stats[0].Method != "*" || stats[0].Current != 1 || stats[0].Limit != 2 ||
+		stats[1].Method != "Wait" || stats[1].Current != 1 || stats[1].Limit != 1 {
+		t.Fatalf("TestBulkhead|ListBulkheads|%v", stats)
+	}
+
+	wg.Wait()
+	if resp := invoke(0); resp.ErrCode != CODE_SERVER_SUCC {
+		t.Fatalf("TestBulkhead|Released|%v", resp)
+	}
+	for _, s := range handler.ListBulkheads() {
+		if s.Current != 0 {
+			t.Fatalf("TestBulkhead|Current|%v", s)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+//方法结果缓存默认的最大数量
+const DEFAULT_CACHE_MAX_ENTRIES = 1024
+
+//方法结果缓存的配置,只适用于结果只依赖参数的幂等方法
+type MethodCache struct {
+	TTL        time.Duration //缓存的有效期
+	MaxEntries int           //最多缓存的结果数,超过按照LRU淘汰,默认1024
+}
+
+//缓存编码后的结果,每次命中重新解码,调用方修改结果不影响缓存
+type cacheEntry struct {
+	key    string
+	result []byte
+	expire time.Time
+}
+
+//方法结果的LRU缓存
+type resultCache struct {
+	ttl        time.Duration
+	maxEntries int
+	lock       sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+func newResultCache(c MethodCache) *resultCache {
+	maxEntries := c.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DEFAULT_CACHE_MAX_ENTRIES
+	}
+	return &resultCache{
+		ttl:        c.TTL,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element, 16),
+		lru:        list.New()}
+}
+
+func (self *resultCache) get(key string, now time.Time) (MoaRespPacket, bool) {
+	self.lock.Lock()
+	e, ok := self.entries[key]
+	if !ok {
+		self.lock.Unlock()
+		return MoaRespPacket{}, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !now.Before(entry.expire) {
+		self.lru.Remove(e)
+		delete(self.entries, key)
+		self.lock.Unlock()
+		return MoaRespPacket{}, false
+	}
+	self.lru.MoveToFront(e)
+	result := entry.result
+	self.lock.Unlock()
+
+	//保留数字的原始精度
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(result))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); nil != err {
+		return MoaRespPacket{}, false
+	}
+	return MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: v}, true
+}
+
+//只缓存成功的结果,无法编码的结果不缓存
+func (self *resultCache) put(key string, resp MoaRespPacket, now time.Time) {
+	if resp.ErrCode != CODE_SERVER_SUCC || len(resp.Message) > 0 {
+		return
+	}
+	result, err := json.Marshal(resp.Result)
+	if nil != err {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if e, ok := self.entries[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.result = result
+		entry.expire = now.Add(self.ttl)
+		self.lru.MoveToFront(e)
+		return
+	}
+	self.entries[key] = self.lru.PushFront(&cacheEntry{key: key, result: result, expire: now.Add(self.ttl)})
+	for self.lru.Len() > self.maxEntries {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+//清空缓存,返回清除的数量
+func (self *resultCache) purge() int {
+	if nil == self {
+		return 0
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	size := self.lru.Len()
+	self.entries = make(map[string]*list.Element, 16)
+	self.lru.Init()
+	return size
+}
+
+//参数规范化后作为缓存的key以及签名的内容,相同的JSON参数不受空白和字段顺序影响
+func canonicalArgs(args []json.RawMessage) string {
+	values := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(arg))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); nil != err {
+			//不合法的参数使用原始内容
+			values = append(values, string(arg))
+			continue
+		}
+		values = append(values, v)
+	}
+	key, _ := json.Marshal(values)
+	return string(key)
+}
+
+//方法结果缓存,命中则不再调用服务实例,只缓存成功的结果
+func (self *InvocationHandler) cacheInterceptor(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+	s, ok := self.lookupService(invocation.ServiceUri, invocation.GroupId)
+	if !ok {
+		return next(ctx, invocation)
+	}
+	m := s.methods[strings.ToLower(invocation.Method)]
+	if nil == m.cache {
+		return next(ctx, invocation)
+	}
+
+	service := BuildServiceUri(s.ServiceUri, s.GroupId)
+	key := canonicalArgs(invocation.Args)
+	if resp, ok := m.cache.get(key, time.Now()); ok {
+		self.moaStat.IncrCacheHit(service, m.Name)
+		return resp
+	}
+	self.moaStat.IncrCacheMiss(service, m.Name)
+	resp := next(ctx, invocation)
+	m.cache.put(key, resp, time.Now())
+	return resp
+}
+
+//清除方法结果缓存,serviceUri为空则清除所有服务,method为空则清除服务的所有方法
+func (self *InvocationHandler) PurgeCache(serviceUri, method string) int {
+	purged := 0
+	for _, s := range self.Services() {
+		if len(serviceUri) > 0 && !matchService(s, serviceUri) {
+			continue
+		}
+		for key, m := range s.methods {
+			if len(method) > 0 && key != strings.ToLower(method) {
+				continue
+			}
+			purged += m.cache.purge()
+		}
+	}
+	log.Infof("InvocationHandler|PurgeCache|%s|%s|%d", serviceUri, method, purged)
+	return purged
+}
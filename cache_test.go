@@ -0,0 +1,192 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCanonicalArgs(t *testing.T) {
+	a := canonicalArgs([]json.RawMessage{json.RawMessage(`{"a":1,"b":[1,2]}`), json.RawMessage(`"x"`)})
+	b := canonicalArgs([]json.RawMessage{json.RawMessage(` { "b":[1, 2], "a":1 } `), json.RawMessage(`"x"`)})
+	if a != b {
+		t.Fatalf("canonical key should be equal %s|%s", a, b)
+	}
+	c := canonicalArgs([]json.RawMessage{json.RawMessage(`{"a":1,"b":[2,1]}`), json.RawMessage(`"x"`)})
+	if a == c {
+		t.Fatalf("different args should have different key %s", c)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	cache := newResultCache(MethodCache{TTL: time.Second, MaxEntries: 2})
+	now := time.Now()
+	cache.put("a", MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: "a"}, now)
+	cache.put("b", MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: "b"}, now)
+	//a最近使用,淘汰b
+	if _, ok := cache.get("a", now); !ok {
+		t.Fatal("a should be cached")
+	}
+	cache.put("c", MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: "c"}, now)
+	if _, ok := cache.get("b", now); ok {
+		t.Fatal("b should be evicted")
+	}
+	if resp, ok := cache.get("c", now); !ok || resp.Result != "c" {
+		t.Fatalf("c should be cached %v", resp)
+	}
+	//过期
+	if _, ok := cache.get("a", now.Add(time.Second)); ok {
+		t.Fatal("a should be expired")
+	}
+	if purged := cache.purge(); purged != 1 {
+		t.Fatalf("purge count %d", purged)
+	}
+}
+
+//命中的结果相互独立,修改不影响缓存
+func TestResultCacheCopy(t *testing.T) {
+	cache := newResultCache(MethodCache{TTL: time.Second})
+	now := time.Now()
+	result := map[string]interface{}{"id": int64(9007199254740993)}
+	cache.put("a", MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: result}, now)
+	result["id"] = 1
+
+	resp, ok := cache.get("a", now)
+	if !ok {
+		t.Fatal("a should be cached")
+	}
+	hit := resp.Result.(map[string]interface{})
+	if hit["id"] != json.Number("9007199254740993") {
+		t.Fatalf("cached result changed %v", hit)
+	}
+	hit["id"] = 2
+	if resp, _ := cache.get("a", now); resp.Result.(map[string]interface{})["id"] != json.Number("9007199254740993") {
+		t.Fatalf("hit should not share result %v", resp.Result)
+	}
+
+	//失败以及带错误信息的结果不缓存
+	cache.put("b", MoaRespPacket{ErrCode: CODE_INVOCATION_TARGET}, now)
+	cache.put("c", MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Message: "Method Invoke Error"}, now)
+	for _, key := range []string{"b", "c"} {
+		if _, ok := cache.get(key, now); ok {
+			t.Fatalf("%s should not be cached", key)
+		}
+	}
+}
+
+func TestInvokeCache(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	called := int32(0)
+
+	for _, c := range []map[string]MethodCache{
+		{"NotExist": {TTL: time.Second}},
+		{"Wait": {}},
+	} {
+		if _, err := newInvocationHandler([]Service{Service{ServiceUri: "slow",
+			Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+			MethodCaches: c}}, stat); nil == err {
+			t.Fatalf("invalid method cache should fail %v", c)
+		}
+	}
+
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+		MethodCaches: map[string]MethodCache{"wait": {TTL: time.Minute}}}}, stat)
+	invokeWithTimeout := func(arg string, timeout time.Duration) MoaRespPacket {
+		raw := MoaRawReqPacket{ServiceUri: "slow", Timeout: timeout, Source: "127.0.0.1:1000"}
+		raw.Params.Method = "Wait"
+		raw.Params.Args = []json.RawMessage{json.RawMessage(arg)}
+		ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+		defer cancel()
+		resp, _ := handler.call(ctx, raw)
+		return resp
+	}
+	invoke := func(arg string) MoaRespPacket {
+		return invokeWithTimeout(arg, 5*time.Second)
+	}
+
+	for _, arg := range []string{"1", " 1", "1 "} {
+		if resp := invoke(arg); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "done" {
+			t.Fatalf("invoke fail %v", resp)
+		}
+	}
+	if atomic.LoadInt32(&called) != 1 {
+		t.Fatalf("cached result should not invoke instance %d", called)
+	}
+	invoke("2")
+	if atomic.LoadInt32(&called) != 2 {
+		t.Fatalf("different args should invoke instance %d", called)
+	}
+
+	//失败的结果不缓存
+	invoke(`"bad"`)
+	invoke(`"bad"`)
+	if atomic.LoadInt32(&called) != 2 {
+		t.Fatalf("invalid args should not invoke instance %d", called)
+	}
+
+	//方法返回error的结果不缓存
+	if resp := invokeWithTimeout("200", 50*time.Millisecond); len(resp.Message) <= 0 {
+		t.Fatalf("timeout invoke should return error %v", resp)
+	}
+	if resp := invoke("200"); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "done" {
+		t.Fatalf("error result should not be cached %v", resp)
+	}
+	if atomic.LoadInt32(&called) != 4 {
+		t.Fatalf("error result should invoke instance again %d", called)
+	}
+
+	if purged := handler.PurgeCache("other", ""); purged != 0 {
+		t.Fatalf("purge other service %d", purged)
+	}
+	if purged := handler.PurgeCache("slow", "WAIT"); purged != 3 {
+		t.Fatalf("purge count %d", purged)
+	}
+	invoke("1")
+	if atomic.LoadInt32(&called) != 5 {
+		t.Fatalf("purged result should invoke instance %d", called)
+	}
+}
+
+func TestAdminPurgeCache(t *testing.T) {
+	called := int32(0)
+	op := testReloadOption()
+	app, err := NewApplicationWithOption(context.TODO(), op, func() []Service {
+		return []Service{
+			Service{
+				ServiceUri:   "slow",
+				Instance:     Slow{called: &called},
+				Interface:    (*ISlow)(nil),
+				MethodCaches: map[string]MethodCache{"wait": {TTL: time.Minute}}},
+		}
+	}, func(serviceUri, host string, moainfo MoaInfo) {})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() {
+		app.stop()
+		app.moaStat.Destroy()
+	}()
+
+	raw := MoaRawReqPacket{ServiceUri: "slow", Timeout: 5 * time.Second, Source: "127.0.0.1:1000"}
+	raw.Params.Method = "Wait"
+	raw.Params.Args = []json.RawMessage{json.RawMessage("1")}
+	app.invokeHandler.call(context.TODO(), raw)
+
+	handler := app.adminHandler()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/moa/cache/purge", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("purge should only accept POST %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/moa/cache/purge?service=slow", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"purged":1}` {
+		t.Fatalf("purge %d|%s", w.Code, w.Body.String())
+	}
+}
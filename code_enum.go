@@ -23,6 +23,9 @@ const (
 	CODE_THREAD_POOL_IS_FULL   = 504
 	CODE_ASYNC_SUBMIT          = 505
 	CODE_IP_NOT_ALLOWED        = 506
+	CODE_SERVER_SHUTDOWN       = 507
+	CODE_RATE_LIMITED          = 508
+	CODE_AUTH_FAILED           = 509
 	CODE_INITIALIZATION_SERVER = 3011
 	CODE_SERIALIZATION_SERVER  = 3021
 	CODE_REMOTING_SERVER       = 3031
@@ -43,4 +46,12 @@ const (
 	MSG_METHOD_NOT_FOUND    = "Method not found: %s."
 	MSG_INVOCATION_TARGET   = "Invocation target exception: (%s)"
 	MSG_THREAD_POOL_IS_FULL = "Threadpool is full: %s"
+	MSG_SERVER_SHUTDOWN     = "Server is shutting down: %s"
+	MSG_USER_CANCELLED      = "User cancelled: %s"
+	MSG_BATCH_SIZE_INVALID  = "Batch size invalid: %d/%d"
+	MSG_STREAM_IN_BATCH     = "Stream result not supported in batch: %s"
+	MSG_RATE_LIMITED        = "Rate limited: %s"
+	MSG_IP_NOT_ALLOWED      = "IP not allowed: %s"
+	MSG_AUTH_FAILED         = "Authentication failed: %s"
+	MSG_IDEMPOTENT_CONFLICT = "Idempotency key reused with different args: %s"
 )
@@ -0,0 +1,287 @@
+package core
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"unicode/utf8"
+)
+
+//参数解码器,在发布服务时按照参数类型生成,调用时把codec切分好的单个参数的原始JSON解码为参数类型
+//args依然先由codec切分为json.RawMessage再逐个解码,认证签名、结果缓存、合并调用以及幂等key都依赖原始参数,
+//所以没有从请求包直接解码到参数类型,解码器只省去每次调用时的类型判断以及基本类型的encoding/json开销
+type argDecoder func(raw json.RawMessage) (reflect.Value, error)
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf(new(json.Unmarshaler)).Elem()
+	textUnmarshalerType = reflect.TypeOf(new(encoding.TextUnmarshaler)).Elem()
+)
+
+//按照参数类型生成解码器
+//只有string、整数、浮点数、bool等基本类型(包括以它们为底层类型的自定义类型)直接解析,
+//slice、map、struct、指针等复合类型以及不符合严格JSON格式的内容交给encoding/json处理以保持相同的行为和错误信息
+//useNumber时包含interface{}的类型中的数字解码为json.Number
+func newArgDecoder(t reflect.Type, useNumber bool) argDecoder {
+	generic := func(raw json.RawMessage) (reflect.Value, error) {
+		inst := reflect.New(t)
+		if err := json.Unmarshal(raw, inst.Interface()); nil != err {
+			return reflect.Value{}, err
+		}
+		return inst.Elem(), nil
+	}
+	if useNumber && hasInterface(t, make(map[reflect.Type]bool)) {
+		generic = func(raw json.RawMessage) (reflect.Value, error) {
+			inst := reflect.New(t)
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.UseNumber()
+			if err := decoder.Decode(inst.Interface()); nil != err {
+				return reflect.Value{}, err
+			}
+			return inst.Elem(), nil
+		}
+	}
+
+	//自定义了反序列化的类型
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) ||
+		reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return generic
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		newString := stringValue(t)
+		return func(raw json.RawMessage) (reflect.Value, error) {
+			s, ok := unquoteFast(raw)
+			if !ok {
+				return generic(raw)
+			}
+			return newString(s), nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits := t.Bits()
+		newInt := intValue(t)
+		return func(raw json.RawMessage) (reflect.Value, error) {
+			if !isJSONInteger(raw) {
+				return generic(raw)
+			}
+			i, err := strconv.ParseInt(string(raw), 10, bits)
+			if nil != err {
+				return generic(raw)
+			}
+			return newInt(i), nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		bits := t.Bits()
+		newUint := uintValue(t)
+		return func(raw json.RawMessage) (reflect.Value, error) {
+			if !isJSONInteger(raw) || raw[0] == '-' {
+				return generic(raw)
+			}
+			u, err := strconv.ParseUint(string(raw), 10, bits)
+			if nil != err {
+				return generic(raw)
+			}
+			return newUint(u), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		bits := t.Bits()
+		newFloat := floatValue(t)
+		return func(raw json.RawMessage) (reflect.Value, error) {
+			if !isJSONNumber(raw) {
+				return generic(raw)
+			}
+			f, err := strconv.ParseFloat(string(raw), bits)
+			if nil != err {
+				return generic(raw)
+			}
+			return newFloat(f), nil
+		}
+	case reflect.Bool:
+		newBool := boolValue(t)
+		return func(raw json.RawMessage) (reflect.Value, error) {
+			s := string(raw)
+			if s != "true" && s != "false" {
+				return generic(raw)
+			}
+			return newBool(s == "true"), nil
+		}
+	}
+	return generic
+}
+
+//预定义的类型直接使用reflect.ValueOf,bool、较小的整数以及空字符串不需要再分配内存
+//自定义的类型(例如 type Name string)需要reflect.New之后设置
+func stringValue(t reflect.Type) func(s string) reflect.Value {
+	if t == reflect.TypeOf("") {
+		return func(s string) reflect.Value { return reflect.ValueOf(s) }
+	}
+	return func(s string) reflect.Value {
+		v := reflect.New(t).Elem()
+		v.SetString(s)
+		return v
+	}
+}
+
+func intValue(t reflect.Type) func(i int64) reflect.Value {
+	switch t {
+	case reflect.TypeOf(int(0)):
+		return func(i int64) reflect.Value { return reflect.ValueOf(int(i)) }
+	case reflect.TypeOf(int8(0)):
+		return func(i int64) reflect.Value { return reflect.ValueOf(int8(i)) }
+	case reflect.TypeOf(int16(0)):
+		return func(i int64) reflect.Value { return reflect.ValueOf(int16(i)) }
+	case reflect.TypeOf(int32(0)):
+		return func(i int64) reflect.Value { return reflect.ValueOf(int32(i)) }
+	case reflect.TypeOf(int64(0)):
+		return func(i int64) reflect.Value { return reflect.ValueOf(i) }
+	}
+	return func(i int64) reflect.Value {
+		v := reflect.New(t).Elem()
+		v.SetInt(i)
+		return v
+	}
+}
+
+func uintValue(t reflect.Type) func(u uint64) reflect.Value {
+	switch t {
+	case reflect.TypeOf(uint(0)):
+		return func(u uint64) reflect.Value { return reflect.ValueOf(uint(u)) }
+	case reflect.TypeOf(uint8(0)):
+		return func(u uint64) reflect.Value { return reflect.ValueOf(uint8(u)) }
+	case reflect.TypeOf(uint16(0)):
+		return func(u uint64) reflect.Value { return reflect.ValueOf(uint16(u)) }
+	case reflect.TypeOf(uint32(0)):
+		return func(u uint64) reflect.Value { return reflect.ValueOf(uint32(u)) }
+	case reflect.TypeOf(uint64(0)):
+		return func(u uint64) reflect.Value { return reflect.ValueOf(u) }
+	}
+	return func(u uint64) reflect.Value {
+		v := reflect.New(t).Elem()
+		v.SetUint(u)
+		return v
+	}
+}
+
+func floatValue(t reflect.Type) func(f float64) reflect.Value {
+	switch t {
+	case reflect.TypeOf(float32(0)):
+		return func(f float64) reflect.Value { return reflect.ValueOf(float32(f)) }
+	case reflect.TypeOf(float64(0)):
+		return func(f float64) reflect.Value { return reflect.ValueOf(f) }
+	}
+	return func(f float64) reflect.Value {
+		v := reflect.New(t).Elem()
+		v.SetFloat(f)
+		return v
+	}
+}
+
+func boolValue(t reflect.Type) func(b bool) reflect.Value {
+	if t == reflect.TypeOf(false) {
+		return func(b bool) reflect.Value { return reflect.ValueOf(b) }
+	}
+	return func(b bool) reflect.Value {
+		v := reflect.New(t).Elem()
+		v.SetBool(b)
+		return v
+	}
+}
+
+//类型中是否包含interface{},只有interface{}会把数字解码为float64
+func hasInterface(t reflect.Type, visited map[reflect.Type]bool) bool {
+	if visited[t] {
+		return false
+	}
+	visited[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return hasInterface(t.Elem(), visited)
+	case reflect.Map:
+		return hasInterface(t.Key(), visited) || hasInterface(t.Elem(), visited)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasInterface(t.Field(i).Type, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//没有转义字符的JSON字符串直接截取内容
+func unquoteFast(raw []byte) (string, bool) {
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return "", false
+	}
+	body := raw[1 : len(raw)-1]
+	for _, c := range body {
+		if c < 0x20 || c == '\\' || c == '"' {
+			return "", false
+		}
+	}
+	if !utf8.Valid(body) {
+		return "", false
+	}
+	return string(body), true
+}
+
+//-?(0|[1-9][0-9]*)
+func isJSONInteger(raw []byte) bool {
+	s := raw
+	if len(s) > 0 && s[0] == '-' {
+		s = s[1:]
+	}
+	if len(s) <= 0 || (s[0] == '0' && len(s) > 1) {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//JSON数字格式 -?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?
+func isJSONNumber(raw []byte) bool {
+	s := raw
+	if len(s) > 0 && s[0] == '-' {
+		s = s[1:]
+	}
+	if len(s) <= 0 {
+		return false
+	}
+	digits := func() bool {
+		n := 0
+		for len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+			s = s[1:]
+			n++
+		}
+		return n > 0
+	}
+	if s[0] == '0' {
+		s = s[1:]
+	} else if !digits() {
+		return false
+	}
+	if len(s) > 0 && s[0] == '.' {
+		s = s[1:]
+		if !digits() {
+			return false
+		}
+	}
+	if len(s) > 0 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+			s = s[1:]
+		}
+		if !digits() {
+			return false
+		}
+	}
+	return len(s) == 0
+}
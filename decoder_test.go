@@ -0,0 +1,296 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blackbeans/turbo"
+)
+
+type decoderName string
+
+type decoderLevel int8
+
+func TestArgDecoder(t *testing.T) {
+	cases := []struct {
+		typ  reflect.Type
+		raws []string
+	}{
+		{reflect.TypeOf(""), []string{`"abc"`, `""`, `"中文"`, `"a\"b"`, `"中"`, `"a\nb"`, `null`, `1`, `"abc`}},
+		{reflect.TypeOf(decoderName("")), []string{`"abc"`, `"a\\b"`, `true`}},
+		{reflect.TypeOf(0), []string{`0`, `-1`, `123456`, `01`, `+1`, `1.0`, `1e2`, `-`, `null`, `"1"`, `9223372036854775808`}},
+		{reflect.TypeOf(int8(0)), []string{`127`, `128`, `-128`, `-129`}},
+		{reflect.TypeOf(decoderLevel(0)), []string{`1`, `300`}},
+		{reflect.TypeOf(uint32(0)), []string{`0`, `4294967295`, `4294967296`, `-1`, `-0`}},
+		{reflect.TypeOf(int16(0)), []string{`-32768`, `32768`}},
+		{reflect.TypeOf(int32(0)), []string{`-2147483648`, `2147483648`}},
+		{reflect.TypeOf(int64(0)), []string{`9223372036854775807`, `9223372036854775808`}},
+		{reflect.TypeOf(uint(0)), []string{`0`, `18446744073709551615`}},
+		{reflect.TypeOf(uint8(0)), []string{`255`, `256`}},
+		{reflect.TypeOf(uint16(0)), []string{`65535`, `65536`}},
+		{reflect.TypeOf(uint64(0)), []string{`18446744073709551615`, `18446744073709551616`}},
+		{reflect.TypeOf(float64(0)), []string{`0`, `-0.5`, `1e10`, `1.5E-3`, `.5`, `1.`, `01.5`, `1e`, `null`, `1e400`}},
+		{reflect.TypeOf(float32(0)), []string{`3.4e38`, `3.5e38`}},
+		{reflect.TypeOf(false), []string{`true`, `false`, `null`, `1`, `"true"`}},
+		{reflect.TypeOf(time.Time{}), []string{`"2006-01-02T15:04:05Z"`, `"abc"`}},
+		{reflect.TypeOf(ProxyParam{}), []string{`{"Name":"a"}`, `[]`}},
+		{reflect.TypeOf([]string{}), []string{`["a","b"]`, `null`}},
+	}
+
+	for _, c := range cases {
+		decode := newArgDecoder(c.typ, false)
+		for _, raw := range c.raws {
+			//与encoding/json的结果一致
+			expect := reflect.New(c.typ)
+			eerr := json.Unmarshal([]byte(raw), expect.Interface())
+
+			v, err := decode(json.RawMessage(raw))
+			if (nil == err) != (nil == eerr) {
+				t.Fatalf("%s|%s|%v|%v", c.typ, raw, err, eerr)
+			}
+			if nil != err {
+				if err.Error() != eerr.Error() {
+					t.Fatalf("%s|%s|%v|%v", c.typ, raw, err, eerr)
+				}
+				continue
+			}
+			if v.Type() != c.typ || !reflect.DeepEqual(v.Interface(), expect.Elem().Interface()) {
+				t.Fatalf("%s|%s|%v|%v", c.typ, raw, v.Interface(), expect.Elem().Interface())
+			}
+		}
+	}
+}
+
+type IDecodeDemo interface {
+	Decode(ctx context.Context, name string, id int64, score float64, ok bool, tags []string) (string, error)
+}
+
+type DecodeDemo struct{}
+
+func (self DecodeDemo) Decode(ctx context.Context, name string, id int64, score float64, ok bool, tags []string) (string, error) {
+	return name, nil
+}
+
+func benchmarkDecodeMeta(b *testing.B) (MethodMeta, []json.RawMessage) {
+	s, err := buildService(Service{ServiceUri: "/service/decode",
+		Interface: (*IDecodeDemo)(nil), Instance: DecodeDemo{}})
+	if nil != err {
+		b.Fatal(err)
+	}
+	args := []json.RawMessage{
+		json.RawMessage(`"bench"`),
+		json.RawMessage(`1234567890`),
+		json.RawMessage(`98.5`),
+		json.RawMessage(`true`),
+		json.RawMessage(`["a","b","c"]`)}
+	return s.methods["decode"], args
+}
+
+//预定义类型的bool以及较小的整数不需要分配内存
+func TestArgDecoderAllocs(t *testing.T) {
+	for _, c := range []struct {
+		typ reflect.Type
+		raw json.RawMessage
+	}{
+		{reflect.TypeOf(false), json.RawMessage(`true`)},
+		{reflect.TypeOf(0), json.RawMessage(`12`)},
+		{reflect.TypeOf(uint8(0)), json.RawMessage(`255`)},
+		{reflect.TypeOf(""), json.RawMessage(`""`)},
+	} {
+		decode := newArgDecoder(c.typ, false)
+		if allocs := testing.AllocsPerRun(100, func() { decode(c.raw) }); allocs != 0 {
+			t.Fatalf("%s|%s allocs %v", c.typ, c.raw, allocs)
+		}
+	}
+}
+
+//原来的解码方式:每次判断类型并reflect.New后json.Unmarshal
+func BenchmarkDecodeArgsLegacy(b *testing.B) {
+	m, args := benchmarkDecodeMeta(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		params := make([]reflect.Value, 0, len(m.ParamTypes))
+		params = append(params, reflect.ValueOf(context.TODO()))
+		paramTypes := m.ParamTypes[1:]
+		for j, arg := range args {
+			inst := reflect.New(paramTypes[j])
+			if err := json.Unmarshal(arg, inst.Interface()); nil != err {
+				b.Fatal(err)
+			}
+			params = append(params, inst.Elem())
+		}
+		invoke(m, params...)
+	}
+}
+
+//预先生成的解码器
+func BenchmarkDecodeArgs(b *testing.B) {
+	m, args := benchmarkDecodeMeta(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		params := make([]reflect.Value, 0, len(m.ParamTypes))
+		params = append(params, reflect.ValueOf(context.TODO()))
+		for j, arg := range args {
+			v, err := m.decoders[j](arg)
+			if nil != err {
+				b.Fatal(err)
+			}
+			params = append(params, v)
+		}
+		invoke(m, params...)
+	}
+}
+
+//包含拦截器、解码、调用以及统计的完整调用
+func BenchmarkInvoke(b *testing.B) {
+	stat := testInitMoaStat(b)
+	defer stat.Destroy()
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "/service/decode",
+		Interface: (*IDecodeDemo)(nil), Instance: DecodeDemo{}}}, stat)
+	_, args := benchmarkDecodeMeta(b)
+	req := MoaRawReqPacket{ServiceUri: "/service/decode", Timeout: 5 * time.Second,
+		Source: "127.0.0.1:1000", Properties: map[string]string{}}
+	req.Params.Method = "Decode"
+	req.Params.Args = args
+	callback := func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_SERVER_SUCC {
+			b.Fatalf("invoke fail %v", resp)
+		}
+		return nil
+	}
+	ctx := context.TODO()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handler.Invoke(ctx, req, callback)
+	}
+}
+
+func BenchmarkDecodeString(b *testing.B) {
+	raw := json.RawMessage(`"` + strings.Repeat("moa", 20) + `"`)
+	b.Run("Legacy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			inst := reflect.New(reflect.TypeOf(""))
+			if err := json.Unmarshal(raw, inst.Interface()); nil != err {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Decoder", func(b *testing.B) {
+		decode := newArgDecoder(reflect.TypeOf(""), false)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := decode(raw); nil != err {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type decoderUser struct {
+	Id    interface{}            `json:"id"`
+	Extra map[string]interface{} `json:"extra"`
+}
+
+func TestArgDecoderUseNumber(t *testing.T) {
+	raw := json.RawMessage(`{"id":9007199254740993,"extra":{"ids":[9223372036854775807,1.5]}}`)
+
+	//默认解码为float64丢失精度
+	v, err := newArgDecoder(reflect.TypeOf(decoderUser{}), false)(raw)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, ok := v.Interface().(decoderUser).Id.(float64); !ok {
+		t.Fatalf("id should be float64 %T", v.Interface().(decoderUser).Id)
+	}
+
+	for _, typ := range []reflect.Type{reflect.TypeOf(decoderUser{}), reflect.TypeOf(&decoderUser{})} {
+		v, err = newArgDecoder(typ, true)(raw)
+		if nil != err {
+			t.Fatal(err)
+		}
+		user := reflect.Indirect(v).Interface().(decoderUser)
+		if id, ok := user.Id.(json.Number); !ok || id.String() != "9007199254740993" {
+			t.Fatalf("id %T %v", user.Id, user.Id)
+		}
+		ids := user.Extra["ids"].([]interface{})
+		if id, ok := ids[0].(json.Number); !ok || id.String() != "9223372036854775807" {
+			t.Fatalf("nested id %T %v", ids[0], ids[0])
+		}
+		if f, _ := ids[1].(json.Number).Float64(); f != 1.5 {
+			t.Fatalf("nested float %v", ids[1])
+		}
+	}
+
+	//不包含interface{}的类型不受影响
+	if hasInterface(reflect.TypeOf(ProxyParam{}), make(map[reflect.Type]bool)) {
+		t.Fatal("ProxyParam has no interface")
+	}
+	v, err = newArgDecoder(reflect.TypeOf(int64(0)), true)(json.RawMessage(`9223372036854775807`))
+	if nil != err || v.Int() != 9223372036854775807 {
+		t.Fatalf("int64 %v %v", v, err)
+	}
+	if _, err = newArgDecoder(reflect.TypeOf(map[string]interface{}{}), true)(json.RawMessage(`[1]`)); nil == err {
+		t.Fatal("should fail")
+	}
+}
+
+type INumberDemo interface {
+	Echo(params map[string]interface{}) (map[string]interface{}, error)
+}
+
+type NumberDemo struct{}
+
+func (self NumberDemo) Echo(params map[string]interface{}) (map[string]interface{}, error) {
+	return params, nil
+}
+
+func TestInvokeUseNumber(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	handler := NewInvocationHandler([]Service{
+		Service{ServiceUri: "number", Instance: NumberDemo{}, Interface: (*INumberDemo)(nil), UseNumber: true},
+		Service{ServiceUri: "float", Instance: NumberDemo{}, Interface: (*INumberDemo)(nil)}}, stat)
+
+	codec := BinaryCodec{}
+	invoke := func(uri string) string {
+		raw := MoaRawReqPacket{ServiceUri: uri, Timeout: 5 * time.Second}
+		raw.Params.Method = "echo"
+		raw.Params.Args = []json.RawMessage{
+			json.RawMessage(`{"uid":9007199254740993,"friends":[{"uid":1234567890123456789}]}`)}
+		var result string
+		handler.Invoke(context.TODO(), raw, func(resp MoaRespPacket) error {
+			if resp.ErrCode != CODE_SERVER_SUCC {
+				t.Fatalf("%s|%v", uri, resp)
+			}
+			//响应编码后保持原始的数字
+			p := turbo.NewPacket(RESP, nil)
+			p.PayLoad = resp
+			data, err := codec.MarshalPayload(p)
+			if nil != err {
+				t.Fatal(err)
+			}
+			rawResp, err := Wrap2MoaRawResponse(data)
+			if nil != err {
+				t.Fatal(err)
+			}
+			result = string(rawResp.Result)
+			return nil
+		})
+		return result
+	}
+
+	if result := invoke("number"); result != `{"friends":[{"uid":1234567890123456789}],"uid":9007199254740993}` {
+		t.Fatalf("UseNumber result %s", result)
+	}
+	if result := invoke("float"); !strings.Contains(result, "9007199254740992") {
+		t.Fatalf("float result %s", result)
+	}
+}
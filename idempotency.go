@@ -0,0 +1,142 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//清理过期幂等记录的最小数量
+const IDEMPOTENCY_SWEEP_SIZE = 1024
+
+//幂等调用的记录
+type idempotentCall struct {
+	done     chan struct{}
+	args     string
+	resp     MoaRespPacket
+	finished bool //成功并记录了响应
+	//完成后开始计算窗口,执行中的调用不会过期
+	expire time.Time
+}
+
+//按照幂等key记录调用的响应,窗口期内重复的调用直接返回记录的响应
+type idempotencyStore struct {
+	window    time.Duration
+	lock      sync.Mutex
+	calls     map[string]*idempotentCall
+	nextSweep int
+}
+
+func newIdempotencyStore(window time.Duration) *idempotencyStore {
+	return &idempotencyStore{window: window,
+		calls:     make(map[string]*idempotentCall, 16),
+		nextSweep: IDEMPOTENCY_SWEEP_SIZE}
+}
+
+//执行调用,duplicate为true表示返回的是之前调用的响应
+//之前的调用还在执行则等待其完成,等待中超时或者被取消则不再等待,之前的调用失败则重新执行
+func (self *idempotencyStore) do(ctx context.Context, key, args string, fn func() MoaRespPacket) (resp MoaRespPacket, duplicate bool) {
+	for {
+		now := time.Now()
+		self.lock.Lock()
+		call, ok := self.calls[key]
+		if !ok || (call.finished && !now.Before(call.expire)) {
+			call = &idempotentCall{done: make(chan struct{}), args: args}
+			self.calls[key] = call
+			self.sweep(now)
+			self.lock.Unlock()
+			return self.execute(key, call, fn), false
+		}
+		self.lock.Unlock()
+
+		if call.args != args {
+			return MoaRespPacket{ErrCode: CODE_INVOCATION_TARGET,
+				Message: fmt.Sprintf(MSG_IDEMPOTENT_CONFLICT, key)}, true
+		}
+		select {
+		case <-call.done:
+			if call.finished {
+				return call.resp, true
+			}
+		case <-ctx.Done():
+			return MoaRespPacket{ErrCode: CODE_TIMEOUT_SERVER,
+				Message: fmt.Sprintf(MSG_TIMEOUT, ctx.Err())}, true
+		}
+	}
+}
+
+func (self *idempotencyStore) execute(key string, call *idempotentCall, fn func() MoaRespPacket) MoaRespPacket {
+	defer func() {
+		//执行异常也需要唤醒等待的调用
+		if crash := recover(); nil != crash {
+			self.finish(key, call, MoaRespPacket{ErrCode: CODE_INVOCATION_TARGET,
+				Message: fmt.Sprintf(MSG_INVOCATION_TARGET, fmt.Sprintf("%v", crash))})
+			panic(crash)
+		}
+	}()
+	resp := fn()
+	self.finish(key, call, resp)
+	return resp
+}
+
+//只记录成功的响应,失败、超时或者取消的调用删除记录,重试时重新执行
+func (self *idempotencyStore) finish(key string, call *idempotentCall, resp MoaRespPacket) {
+	self.lock.Lock()
+	if resp.ErrCode == CODE_SERVER_SUCC && len(resp.Message) <= 0 {
+		call.resp = resp
+		call.finished = true
+		call.expire = time.Now().Add(self.window)
+	} else if self.calls[key] == call {
+		delete(self.calls, key)
+	}
+	self.lock.Unlock()
+	close(call.done)
+}
+
+//记录数超过阈值时清理过期的记录,需要持有lock
+func (self *idempotencyStore) sweep(now time.Time) {
+	if len(self.calls) < self.nextSweep {
+		return
+	}
+	for key, call := range self.calls {
+		if call.finished && !now.Before(call.expire) {
+			delete(self.calls, key)
+		}
+	}
+	self.nextSweep = len(self.calls) * 2
+	if self.nextSweep < IDEMPOTENCY_SWEEP_SIZE {
+		self.nextSweep = IDEMPOTENCY_SWEEP_SIZE
+	}
+}
+
+//带有幂等key的调用在窗口期内只执行一次
+func (self *InvocationHandler) idempotencyInterceptor(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+	idemKey := invocation.Properties[KEY_MOA_PROPERTY_IDEMPOTENCY_KEY]
+	if len(idemKey) <= 0 {
+		return next(ctx, invocation)
+	}
+	s, ok := self.lookupService(invocation.ServiceUri, invocation.GroupId)
+	if !ok {
+		return next(ctx, invocation)
+	}
+	m := s.methods[strings.ToLower(invocation.Method)]
+	if nil == m.idempotency {
+		return next(ctx, invocation)
+	}
+
+	//认证的调用方之间的幂等key相互隔离
+	if caller, ok := GetMoaCaller(ctx); ok {
+		idemKey = caller + "|" + idemKey
+	}
+	resp, duplicate := m.idempotency.do(ctx, idemKey, canonicalArgs(invocation.Args), func() MoaRespPacket {
+		return next(ctx, invocation)
+	})
+	if duplicate {
+		self.moaStat.IncrDuplicate(BuildServiceUri(s.ServiceUri, s.GroupId), m.Name)
+		log.Infof("InvocationHandler|Idempotency|Duplicate|Source:%s|%s|%s|%s",
+			invocation.Source, invocation.ServiceUri, invocation.Method, idemKey)
+	}
+	return resp
+}
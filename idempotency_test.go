@@ -0,0 +1,154 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	store := newIdempotencyStore(50 * time.Millisecond)
+	executed := 0
+	fn := func() MoaRespPacket {
+		executed++
+		return MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: executed}
+	}
+
+	if resp, dup := store.do(context.TODO(), "k", "[1]", fn); dup || resp.Result != 1 {
+		t.Fatalf("first call should execute %v", resp)
+	}
+	if resp, dup := store.do(context.TODO(), "k", "[1]", fn); !dup || resp.Result != 1 {
+		t.Fatalf("duplicate call should return stored response %v", resp)
+	}
+	//相同的key不同的参数
+	if resp, dup := store.do(context.TODO(), "k", "[2]", fn); !dup || resp.ErrCode != CODE_INVOCATION_TARGET {
+		t.Fatalf("conflict args should be rejected %v", resp)
+	}
+	//窗口期后重新执行
+	time.Sleep(60 * time.Millisecond)
+	if resp, dup := store.do(context.TODO(), "k", "[1]", fn); dup || resp.Result != 2 {
+		t.Fatalf("expired key should execute again %v", resp)
+	}
+
+	//失败的调用不记录,重试时重新执行
+	failed := func() MoaRespPacket {
+		executed++
+		return MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Message: "Method Invoke Error"}
+	}
+	if resp, dup := store.do(context.TODO(), "f", "[1]", failed); dup || len(resp.Message) <= 0 {
+		t.Fatalf("failed call should execute %v", resp)
+	}
+	if _, ok := store.calls["f"]; ok {
+		t.Fatal("failed call should not be stored")
+	}
+	if resp, dup := store.do(context.TODO(), "f", "[1]", fn); dup || resp.Result != 4 {
+		t.Fatalf("retry after failure should execute %v", resp)
+	}
+
+	//等待中的重复调用在之前的调用失败后重新执行
+	release := make(chan struct{})
+	go store.do(context.TODO(), "w", "[1]", func() MoaRespPacket {
+		<-release
+		return MoaRespPacket{ErrCode: CODE_TIMEOUT_SERVER}
+	})
+	for {
+		store.lock.Lock()
+		_, ok := store.calls["w"]
+		store.lock.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.AfterFunc(10*time.Millisecond, func() { close(release) })
+	if resp, dup := store.do(context.TODO(), "w", "[1]", func() MoaRespPacket {
+		return MoaRespPacket{ErrCode: CODE_SERVER_SUCC, Result: "retried"}
+	}); dup || resp.Result != "retried" {
+		t.Fatalf("waiting call should execute after failure %v", resp)
+	}
+
+	//过期的记录在数量达到阈值后清理
+	store = newIdempotencyStore(10 * time.Millisecond)
+	for i := 0; i < IDEMPOTENCY_SWEEP_SIZE-1; i++ {
+		store.do(context.TODO(), string(rune(i+1000)), "[]", fn)
+	}
+	time.Sleep(20 * time.Millisecond)
+	store.do(context.TODO(), "last", "[]", fn)
+	if len(store.calls) != 1 {
+		t.Fatalf("expired calls should be swept %d", len(store.calls))
+	}
+}
+
+func TestInvokeIdempotency(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	called := int32(0)
+
+	if _, err := newInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+		MethodIdempotency: map[string]time.Duration{"wait": 0}}}, stat); nil == err {
+		t.Fatal("invalid idempotency window should fail")
+	}
+
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+		MethodIdempotency: map[string]time.Duration{"Wait": time.Minute}}}, stat)
+	invoke := func(ctx context.Context, key string) MoaRespPacket {
+		raw := MoaRawReqPacket{ServiceUri: "slow", Timeout: 5 * time.Second, Source: "127.0.0.1:1000",
+			Properties: map[string]string{}}
+		if len(key) > 0 {
+			raw.Properties[KEY_MOA_PROPERTY_IDEMPOTENCY_KEY] = key
+		}
+		raw.Params.Method = "Wait"
+		raw.Params.Args = []json.RawMessage{json.RawMessage("50")}
+		resp, _ := handler.call(ctx, raw)
+		return resp
+	}
+
+	//第一次执行中重复的调用等待结果
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := invoke(context.TODO(), "k1"); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "done" {
+				t.Errorf("duplicate call should share response %v", resp)
+			}
+		}()
+	}
+	wg.Wait()
+	invoke(context.TODO(), "k1")
+	if atomic.LoadInt32(&called) != 1 {
+		t.Fatalf("duplicate calls should not execute %d", called)
+	}
+
+	//不同的key以及没有key的调用正常执行
+	invoke(context.TODO(), "k2")
+	invoke(context.TODO(), "")
+	invoke(context.TODO(), "")
+	if atomic.LoadInt32(&called) != 4 {
+		t.Fatalf("calls without duplicate key should execute %d", called)
+	}
+
+	//超时失败的调用不记录,使用相同的key重试重新执行
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	if resp := invoke(ctx, "k3"); resp.ErrCode == CODE_SERVER_SUCC && len(resp.Message) <= 0 {
+		t.Fatalf("timeout call should fail %v", resp)
+	}
+	cancel()
+	if resp := invoke(context.TODO(), "k3"); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "done" {
+		t.Fatalf("retry should succeed %v", resp)
+	}
+	if atomic.LoadInt32(&called) != 6 {
+		t.Fatalf("retry after failure should execute %d", called)
+	}
+
+	//认证的调用方之间相互隔离
+	invoke(withMoaCaller(context.TODO(), "app1"), "k1")
+	if atomic.LoadInt32(&called) != 7 {
+		t.Fatalf("keys of different callers should be isolated %d", called)
+	}
+}
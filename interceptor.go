@@ -0,0 +1,164 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+//一次调用的信息
+type Invocation struct {
+	ServiceUri string            //调用的服务
+	GroupId    string            //调用的分组,没有指定为*
+	Method     string            //调用的方法
+	Args       []json.RawMessage //原始的参数
+	Properties map[string]string //调用的属性
+	Source     string            //调用来源 ip:port
+	Timeout    time.Duration     //处理超时时间
+	CreateTime int64             //请求创建时间 ms
+}
+
+//执行调用并返回结果
+type Invoker func(ctx context.Context, invocation *Invocation) MoaRespPacket
+
+//服务端拦截器,调用next继续执行拦截器链,不调用则直接返回结果
+type Interceptor func(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket
+
+//注册拦截器,按照注册顺序由外向内执行
+//内置的tracing、统计、异常捕获始终在用户拦截器的外层,幂等去重、结果缓存、合并调用在用户拦截器的内层
+func (self *InvocationHandler) Use(interceptors ...Interceptor) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	tmp := make([]Interceptor, 0, len(self.interceptors)+len(interceptors))
+	tmp = append(tmp, self.interceptors...)
+	self.interceptors = append(tmp, interceptors...)
+	self.chain = self.buildChain()
+}
+
+//当前的调用链
+func (self *InvocationHandler) invoker() Invoker {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.chain
+}
+
+//组装调用链
+func (self *InvocationHandler) buildChain() Invoker {
+	interceptors := make([]Interceptor, 0, len(self.interceptors)+7)
+	interceptors = append(interceptors,
+		TracingInterceptor,
+		self.statInterceptor,
+		RecoveryInterceptor,
+		self.bulkheadInterceptor)
+	interceptors = append(interceptors, self.interceptors...)
+	//幂等去重、结果缓存和合并调用在最内层,命中时用户拦截器依然执行
+	interceptors = append(interceptors,
+		self.idempotencyInterceptor,
+		self.cacheInterceptor,
+		self.singleflightInterceptor)
+
+	chain := Invoker(self.invoke0)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := chain
+		chain = func(ctx context.Context, invocation *Invocation) MoaRespPacket {
+			return interceptor(ctx, invocation, next)
+		}
+	}
+	return chain
+}
+
+//tracing
+//有parent span时我们才开启child span，否则说明调用端没有开启 tracing
+func TracingInterceptor(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+	parentSpanCtx := GetSpanCtx(ctx) // 从当前的请求中获取 parent span
+	if parentSpanCtx == nil {
+		return next(ctx, invocation)
+	}
+
+	// 从parent span中生成 child span
+	childSpan := opentracing.GlobalTracer().StartSpan(invocation.Method, opentracing.ChildOf(parentSpanCtx))
+	// Invoke结束时停止当前span
+	defer childSpan.Finish()
+	// 将 child span 写入 ctx
+	ctx = WithSpanCtx(ctx, childSpan.Context())
+
+	// 将入参写到 span log 中
+	for i, arg := range invocation.Args {
+		v, err := json.Marshal(arg)
+		if err == nil {
+			childSpan.LogKV(fmt.Sprintf("param.%d", i), string(v))
+		}
+	}
+	// 将 moaCtx 有关信息写到 span tag 中
+	if props := ctx.Value(KEY_MOA_PROPERTIES); props != nil {
+		// 从 moa.props 中获取 key value 设置到 child span 的 tag
+		for k, v := range props.(map[string]string) {
+			childSpan.SetTag("moa."+k, v)
+		}
+	}
+
+	resp := next(ctx, invocation)
+
+	// 请求响应时的一些 set
+	childSpan.SetTag("resp.ec", resp.ErrCode)
+	childSpan.SetTag("resp.em", resp.Message)
+	rawJson, err := json.Marshal(resp.Result)
+	if err == nil {
+		childSpan.LogKV("resp.result", string(rawJson))
+	}
+	if resp.ErrCode != CODE_SERVER_SUCC {
+		childSpan.SetTag("error", true)
+	}
+	return resp
+}
+
+//捕获运行时异常
+func RecoveryInterceptor(ctx context.Context, invocation *Invocation, next Invoker) (resp MoaRespPacket) {
+	defer func() {
+		if crash := recover(); nil != crash {
+			resp = MoaRespPacket{}
+			resp.ErrCode = CODE_INVOCATION_TARGET
+			resp.Message = fmt.Sprintf(MSG_INVOCATION_TARGET, fmt.Sprintf("%v", crash))
+			log.Errorf("InvocationHandler|Invoke|Panic|%v|Source:%s|Timeout[%d]ms|%s|%v", crash,
+				invocation.Source, invocation.Timeout/time.Millisecond, invocation.ServiceUri, invocation.Method)
+		}
+	}()
+	return next(ctx, invocation)
+}
+
+//调用统计、耗时以及慢调用日志
+func (self *InvocationHandler) statInterceptor(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+	self.moaStat.IncrRecv()
+	now := time.Now()
+
+	resp := MoaRespPacket{}
+	//还没有执行就被取消了则不再执行
+	if !IsUserCancelled(ctx) {
+		resp = next(ctx, invocation)
+	}
+
+	if IsUserCancelled(ctx) {
+		self.moaStat.IncrCancel()
+		resp = MoaRespPacket{ErrCode: CODE_USER_CANCELLED,
+			Message: fmt.Sprintf(MSG_USER_CANCELLED, invocation.Method)}
+	} else if resp.ErrCode == CODE_SERVER_SUCC {
+		self.moaStat.IncrProc()
+	} else {
+		self.moaStat.IncrError()
+	}
+
+	// 记录耗时
+	cost := time.Now().Sub(now)
+	self.moaStat.MoaMetrics.RpcInvokeDurationSummary.WithLabelValues(invocation.Method).Observe(cost.Seconds())
+	// 长耗时
+	if cost >= time.Duration(atomic.LoadInt64(&self.slowThreshold)) {
+		log.Warnf("InvocationHandler|Invoke|Call|Slow|Source:%s|Cost[%d]ms|%s|%v",
+			invocation.Source, cost/time.Millisecond, invocation.ServiceUri, invocation.Method)
+	}
+	return resp
+}
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInterceptorChain(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "demo",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil)}}, stat)
+
+	orders := make([]string, 0, 4)
+	handler.Use(func(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+		orders = append(orders, "first")
+		if invocation.ServiceUri != "demo" || invocation.Method != "ProxyDemoSlice" ||
+			len(invocation.Args) != 3 || invocation.Properties["app"] != "test" {
+			t.Errorf("TestInterceptorChain|Invocation|%+v", invocation)
+		}
+		resp := next(ctx, invocation)
+		orders = append(orders, "first-resp")
+		return resp
+	}, func(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+		orders = append(orders, "second")
+		resp := next(ctx, invocation)
+		orders = append(orders, "second-resp")
+		return resp
+	})
+
+	req := &MoaReqPacket{}
+	req.ServiceUri = "demo"
+	req.Params.Args = []interface{}{"fuck", []string{"a", "b"}, ProxyParam{"you"}}
+	req.Params.Method = "ProxyDemoSlice"
+	req.Timeout = 5 * time.Second
+	raw := MoaRequest2Raw(req)
+	raw.Properties = map[string]string{"app": "test"}
+	handler.Invoke(context.TODO(), *raw, func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_SERVER_SUCC {
+			t.Errorf("TestInterceptorChain|Invoke|%v", resp)
+		}
+		return nil
+	})
+
+	expect := []string{"first", "second", "second-resp", "first-resp"}
+	if len(orders) != len(expect) {
+		t.Fatalf("TestInterceptorChain|Orders|%v", orders)
+	}
+	for i := range expect {
+		if orders[i] != expect[i] {
+			t.Fatalf("TestInterceptorChain|Orders|%v", orders)
+		}
+	}
+}
+
+func TestInterceptorShortCircuitAndPanic(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "demo",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil)}}, stat)
+
+	handler.Use(func(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+		if invocation.Method == "panic" {
+			panic("interceptor panic")
+		}
+		if invocation.Source != "127.0.0.1:1000" {
+			return MoaRespPacket{ErrCode: CODE_IP_NOT_ALLOWED, Message: invocation.Source}
+		}
+		return next(ctx, invocation)
+	})
+
+	req := &MoaReqPacket{}
+	req.ServiceUri = "demo"
+	req.Params.Args = []interface{}{"fuck", []string{"a", "b"}, ProxyParam{"you"}}
+	req.Params.Method = "ProxyDemoSlice"
+	req.Timeout = 5 * time.Second
+	raw := MoaRequest2Raw(req)
+	raw.Source = "127.0.0.1:2000"
+	handler.Invoke(context.TODO(), *raw, func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_IP_NOT_ALLOWED {
+			t.Errorf("TestInterceptorShortCircuitAndPanic|Reject|%v", resp)
+		}
+		return nil
+	})
+
+	raw.Params.Method = "panic"
+	handler.Invoke(context.TODO(), *raw, func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_INVOCATION_TARGET {
+			t.Errorf("TestInterceptorShortCircuitAndPanic|Panic|%v", resp)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,479 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blackbeans/turbo"
+)
+
+const (
+	LISTENER_TCP  = "tcp://"
+	LISTENER_UNIX = "unix://"
+)
+
+//网络监听,TcpServer以及UnixServer
+type IListener interface {
+	ListenAndServer() error
+	NetworkStat() turbo.NetworkStat
+	ListClients() []string
+	Shutdown()
+}
+
+//解析监听地址 tcp://:13100 或者 unix:///var/run/moa.sock
+//没有scheme的默认为tcp
+func parseListenAddress(address string) (network, addr string, err error) {
+	if strings.HasPrefix(address, LISTENER_UNIX) {
+		network, addr = "unix", strings.TrimPrefix(address, LISTENER_UNIX)
+	} else {
+		network, addr = "tcp", strings.TrimPrefix(address, LISTENER_TCP)
+	}
+	if len(addr) <= 0 {
+		return network, addr, fmt.Errorf("Listener Address Invalid! [%s]", address)
+	}
+	return network, addr, nil
+}
+
+//每个监听使用独立的网络层配置,网络状态分别统计
+func newTConfig(name string, cluster Cluster) *turbo.TConfig {
+	return turbo.NewTConfig(name,
+		cluster.MaxDispatcherSize,
+		cluster.ReadBufferSize,
+		cluster.ReadBufferSize,
+		cluster.WriteChannelSize,
+		cluster.ReadChannelSize,
+		cluster.IdleTimeout,
+		50*10000)
+}
+
+//可重复启动的监听: 关闭后的监听无法再次使用,
+//启动失败回滚之后重新Start时按需创建新的监听,Shutdown只对监听中的实例生效一次
+type managedListener struct {
+	lock      sync.Mutex
+	build     func() IListener
+	current   IListener
+	listening bool
+	stale     bool
+}
+
+func newManagedListener(build func() IListener) *managedListener {
+	return &managedListener{build: build, current: build()}
+}
+
+func (self *managedListener) ListenAndServer() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.listening {
+		return nil
+	}
+	if self.stale {
+		self.current = self.build()
+		self.stale = false
+	}
+	if err := self.current.ListenAndServer(); nil != err {
+		//监听失败的实例可能已经持有资源,下次重新创建
+		self.current.Shutdown()
+		self.stale = true
+		return err
+	}
+	self.listening = true
+	return nil
+}
+
+func (self *managedListener) NetworkStat() turbo.NetworkStat {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.current.NetworkStat()
+}
+
+func (self *managedListener) ListClients() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.current.ListClients()
+}
+
+func (self *managedListener) Shutdown() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.listening {
+		return
+	}
+	self.current.Shutdown()
+	self.listening = false
+	self.stale = true
+}
+
+//调用方的连接,turbo的TClient或者unix socket的连接
+type RemoteClient interface {
+	RemoteAddr() string
+	Write(p turbo.Packet) error
+	Pong(opaque uint32, version int64)
+}
+
+//tcp连接的keepalive间隔,和turbo.TServer一致
+const TCP_KEEPALIVE = 5 * time.Minute
+
+//TCP的服务端,连接仍然交给turbo.TClient处理
+//turbo.TServer关闭时不会关闭监听的socket并且重复Shutdown会panic
+type TcpServer struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	hostport  string
+	config    *turbo.TConfig
+	codec     func() turbo.ICodec
+	onMessage turbo.THandler
+	listener  *net.TCPListener
+	once      sync.Once
+}
+
+func NewTcpServer(hostport string, config *turbo.TConfig, codec func() turbo.ICodec,
+	onMessage turbo.THandler) *TcpServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TcpServer{
+		ctx:       ctx,
+		cancel:    cancel,
+		hostport:  hostport,
+		config:    config,
+		codec:     codec,
+		onMessage: onMessage}
+}
+
+func (self *TcpServer) ListenAndServer() error {
+	addr, err := net.ResolveTCPAddr("tcp4", self.hostport)
+	if nil != err {
+		log.Errorf("TcpServer|ADDR|FAIL|%v|%s", err, self.hostport)
+		return err
+	}
+
+	listener, err := net.ListenTCP("tcp4", addr)
+	if nil != err {
+		log.Errorf("TcpServer|Listen|FAIL|%v|%s", err, self.hostport)
+		return err
+	}
+	self.listener = listener
+
+	go self.serve()
+	log.Infof("TcpServer|ListenAndServer|SUCC|%s", self.hostport)
+	return nil
+}
+
+//接收tcp连接,失败时退避重试
+func (self *TcpServer) serve() {
+	delay := time.Duration(0)
+	for {
+		conn, err := self.listener.AcceptTCP()
+		if nil != err {
+			select {
+			case <-self.ctx.Done():
+				return
+			default:
+			}
+			if delay <= 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > MAX_ACCEPT_DELAY {
+				delay = MAX_ACCEPT_DELAY
+			}
+			log.Errorf("TcpServer|serve|Accept|FAIL|%v|Retry:%s", err, delay)
+			select {
+			case <-self.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+		conn.SetKeepAlive(true)
+		conn.SetKeepAlivePeriod(TCP_KEEPALIVE)
+		turbo.NewTClient(self.ctx, conn, self.codec, self.onMessage, self.config).Start()
+	}
+}
+
+func (self *TcpServer) NetworkStat() turbo.NetworkStat {
+	return self.config.FlowStat.Stat()
+}
+
+func (self *TcpServer) ListClients() []string {
+	clients := make([]string, 0, 10)
+	self.config.FlowStat.Clients.Range(func(key, value interface{}) bool {
+		clients = append(clients, key.(string))
+		return true
+	})
+	return clients
+}
+
+//关闭监听并断开所有连接,可以重复调用
+func (self *TcpServer) Shutdown() {
+	self.once.Do(func() {
+		self.cancel()
+		if nil != self.listener {
+			self.listener.Close()
+		}
+		log.Infof("TcpServer|Shutdown|%s...", self.hostport)
+	})
+}
+
+//unix socket连接上收到的消息,err不为空时为读取或者解析失败
+type UnixHandler func(client RemoteClient, message *turbo.Packet, err error)
+
+//Accept失败时的最大重试间隔
+const MAX_ACCEPT_DELAY = time.Second
+
+//Unix domain socket的服务端
+//按照turbo的协议直接读写unix socket连接,调用来源为 unix://path#连接序号
+type UnixServer struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	path      string
+	config    *turbo.TConfig
+	codec     func() turbo.ICodec
+	onMessage UnixHandler
+	//解析和分发消息的协程池
+	dispatcher *turbo.GPool
+	listener   *net.UnixListener
+	seq        uint64
+	once       sync.Once
+}
+
+func NewUnixServer(path string, config *turbo.TConfig, maxDispatcherSize int, codec func() turbo.ICodec,
+	onMessage UnixHandler) *UnixServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &UnixServer{
+		ctx:        ctx,
+		cancel:     cancel,
+		path:       path,
+		config:     config,
+		codec:      codec,
+		onMessage:  onMessage,
+		dispatcher: turbo.NewLimitPool(ctx, maxDispatcherSize)}
+}
+
+func (self *UnixServer) ListenAndServer() error {
+	//上次没有正常退出残留的socket文件
+	if fi, err := os.Stat(self.path); nil == err && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(self.path)
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: self.path, Net: "unix"})
+	if nil != err {
+		log.Errorf("UnixServer|Listen|FAIL|%v|%s", err, self.path)
+		return err
+	}
+	self.listener = listener
+
+	go self.serve()
+	log.Infof("UnixServer|ListenAndServer|SUCC|%s", self.path)
+	return nil
+}
+
+//接收unix socket连接,失败时退避重试
+func (self *UnixServer) serve() {
+	delay := time.Duration(0)
+	for {
+		conn, err := self.listener.AcceptUnix()
+		if nil != err {
+			select {
+			case <-self.ctx.Done():
+				return
+			default:
+			}
+			if delay <= 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > MAX_ACCEPT_DELAY {
+				delay = MAX_ACCEPT_DELAY
+			}
+			log.Errorf("UnixServer|serve|Accept|FAIL|%v|Retry:%s", err, delay)
+			select {
+			case <-self.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+		seq := atomic.AddUint64(&self.seq, 1)
+		newUnixSession(self, conn, fmt.Sprintf("%s%s#%d", LISTENER_UNIX, self.path, seq)).open()
+	}
+}
+
+func (self *UnixServer) NetworkStat() turbo.NetworkStat {
+	return self.config.FlowStat.Stat()
+}
+
+func (self *UnixServer) ListClients() []string {
+	clients := make([]string, 0, 10)
+	self.config.FlowStat.Clients.Range(func(key, value interface{}) bool {
+		clients = append(clients, key.(string))
+		return true
+	})
+	return clients
+}
+
+func (self *UnixServer) Shutdown() {
+	self.once.Do(func() {
+		self.cancel()
+		if nil != self.listener {
+			self.listener.Close()
+		}
+		log.Infof("UnixServer|Shutdown|%s...", self.path)
+	})
+}
+
+//unix socket的连接,读取和写出分别在独立的协程中
+type unixSession struct {
+	server    *UnixServer
+	conn      *net.UnixConn
+	source    string
+	wchan     chan *turbo.Packet
+	ctx       context.Context
+	cancel    context.CancelFunc
+	once      sync.Once
+	heartbeat int64
+}
+
+func newUnixSession(server *UnixServer, conn *net.UnixConn, source string) *unixSession {
+	ctx, cancel := context.WithCancel(server.ctx)
+	return &unixSession{
+		server: server,
+		conn:   conn,
+		source: source,
+		wchan:  make(chan *turbo.Packet, server.config.WriteChannelSize),
+		ctx:    ctx,
+		cancel: cancel}
+}
+
+func (self *unixSession) open() {
+	self.server.config.FlowStat.Connections.Incr(1)
+	self.server.config.FlowStat.Clients.Store(self.source, self)
+	go self.read()
+	go self.write()
+	log.Infof("UnixSession|Open|SUCC|%s", self.source)
+}
+
+func (self *unixSession) RemoteAddr() string {
+	return self.source
+}
+
+func (self *unixSession) Pong(opaque uint32, version int64) {
+	for {
+		last := atomic.LoadInt64(&self.heartbeat)
+		if version <= last || atomic.CompareAndSwapInt64(&self.heartbeat, last, version) {
+			return
+		}
+	}
+}
+
+//异步写出,连接关闭或者写队列满时返回错误
+func (self *unixSession) Write(p turbo.Packet) error {
+	select {
+	case <-self.ctx.Done():
+		return fmt.Errorf("UnixSession [%s] Closed", self.source)
+	default:
+	}
+	select {
+	case self.wchan <- &p:
+		return nil
+	default:
+		return fmt.Errorf("WRITE CHANNEL [%s] FULL", self.source)
+	}
+}
+
+//按照turbo的协议读取packet,在协程池中解析并分发
+func (self *unixSession) read() {
+	defer self.close()
+	config := self.server.config
+	br := bufio.NewReaderSize(self.conn, config.ReadBufferSize)
+	head := make([]byte, turbo.PACKET_HEAD_LEN)
+	for {
+		if _, err := io.ReadFull(br, head); nil != err {
+			if err != io.EOF {
+				log.Errorf("UnixSession|Read|%s|FAIL|%v", self.source, err)
+			}
+			return
+		}
+		header, err := turbo.UnmarshalHeader(bytes.NewReader(head))
+		if nil == err && (header.BodyLen < 0 || header.BodyLen > turbo.MAX_PACKET_BYTES) {
+			err = turbo.ERR_TOO_LARGE_PACKET
+		}
+		if nil != err {
+			log.Errorf("UnixSession|UnmarshalHeader|%s|FAIL|%v", self.source, err)
+			self.server.onMessage(self, &turbo.Packet{Header: header}, err)
+			return
+		}
+		body := make([]byte, header.BodyLen)
+		if _, err := io.ReadFull(br, body); nil != err {
+			log.Errorf("UnixSession|ReadBody|%s|FAIL|%v|bodyLen:%d", self.source, err, header.BodyLen)
+			return
+		}
+		config.FlowStat.ReadFlow.Incr(1)
+		config.FlowStat.ReadBytesFlow.Incr(turbo.PACKET_HEAD_LEN + header.BodyLen)
+
+		p := &turbo.Packet{Header: header, Data: body}
+		self.server.dispatcher.Queue(self.ctx, func(ctx context.Context) (interface{}, error) {
+			payload, err := self.server.codec().UnmarshalPayload(p)
+			if nil != err {
+				log.Errorf("UnixSession|UnmarshalPayload|%s|FAIL|%v|bodyLen:%d", self.source, err, header.BodyLen)
+				self.server.onMessage(self, p, err)
+				return nil, nil
+			}
+			p.PayLoad = payload
+			self.server.onMessage(self, p, nil)
+			return nil, nil
+		})
+	}
+}
+
+//写出队列中的packet,队列为空时flush
+func (self *unixSession) write() {
+	defer self.close()
+	config := self.server.config
+	codec := self.server.codec()
+	bw := bufio.NewWriterSize(self.conn, config.WriteBufferSize)
+	for {
+		select {
+		case <-self.ctx.Done():
+			return
+		case p := <-self.wchan:
+			raw, err := codec.MarshalPayload(p)
+			if nil == err && len(raw) > turbo.MAX_PACKET_BYTES {
+				err = turbo.ERR_TOO_LARGE_PACKET
+			}
+			if nil != err {
+				log.Errorf("UnixSession|Write|MarshalPayload|%s|FAIL|%v", self.source, err)
+				continue
+			}
+			p.Data = raw
+			data := p.Marshal()
+			if _, err := bw.Write(data); nil != err {
+				log.Errorf("UnixSession|Write|%s|FAIL|%v", self.source, err)
+				return
+			}
+			if len(self.wchan) <= 0 {
+				if err := bw.Flush(); nil != err {
+					log.Errorf("UnixSession|Flush|%s|FAIL|%v", self.source, err)
+					return
+				}
+			}
+			config.FlowStat.WriteFlow.Incr(1)
+			config.FlowStat.WriteBytesFlow.Incr(int32(len(data)))
+		}
+	}
+}
+
+func (self *unixSession) close() {
+	self.once.Do(func() {
+		self.cancel()
+		self.conn.Close()
+		self.server.config.FlowStat.Connections.Incr(-1)
+		self.server.config.FlowStat.Clients.Delete(self.source)
+		log.Infof("UnixSession|Close|%s...", self.source)
+	})
+}
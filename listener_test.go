@@ -0,0 +1,96 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blackbeans/turbo"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	network, addr, err := parseListenAddress("unix:///tmp/moa.sock")
+	if nil != err || network != "unix" || addr != "/tmp/moa.sock" {
+		t.Fatalf("unix address %s|%s|%v", network, addr, err)
+	}
+	network, addr, err = parseListenAddress("tcp://:13100")
+	if nil != err || network != "tcp" || addr != ":13100" {
+		t.Fatalf("tcp address %s|%s|%v", network, addr, err)
+	}
+	network, addr, err = parseListenAddress(":13100")
+	if nil != err || network != "tcp" || addr != ":13100" {
+		t.Fatalf("default tcp address %s|%s|%v", network, addr, err)
+	}
+	if _, _, err = parseListenAddress("unix://"); nil == err {
+		t.Fatal("empty unix address should fail")
+	}
+}
+
+func TestUnixServer(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "go-moa-test.sock")
+	config := newTConfig("unix://"+path, fillDefaults(testReloadOption()).Clusters["dev"])
+	sources := make(chan string, 1)
+	server := NewUnixServer(path, config, 10, func() turbo.ICodec {
+		return BinaryCodec{MaxFrameLength: turbo.MAX_PACKET_BYTES}
+	}, func(client RemoteClient, message *turbo.Packet, err error) {
+		sources <- client.RemoteAddr()
+		//PING直接回复PONG
+		resp := turbo.NewRespPacket(message.Header.Opaque, PONG, nil)
+		resp.PayLoad = message.PayLoad
+		client.Write(*resp)
+	})
+	if err := server.ListenAndServer(); nil != err {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	conn, err := net.Dial("unix", path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, _ := json.Marshal(PiPo{Timestamp: 1})
+	p := turbo.NewPacket(PING, data)
+	p.Header.Opaque = 1
+	if _, err := conn.Write(p.Marshal()); nil != err {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	head := make([]byte, turbo.PACKET_HEAD_LEN)
+	if _, err := io.ReadFull(conn, head); nil != err {
+		t.Fatal(err)
+	}
+	header, err := turbo.UnmarshalHeader(bytes.NewReader(head))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if header.CmdType != PONG || header.Opaque != 1 {
+		t.Fatalf("unexpected response %+v", header)
+	}
+
+	//调用来源为unix socket而不是回环地址
+	source := <-sources
+	if source != "unix://"+path+"#1" || sourceIP(source) != "unix://"+path {
+		t.Fatalf("unix source %s", source)
+	}
+	if clients := server.ListClients(); len(clients) != 1 || clients[0] != source {
+		t.Fatalf("unix clients %v", clients)
+	}
+
+	conn.Close()
+	for i := 0; i < 100 && len(server.ListClients()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(server.ListClients()) != 0 {
+		t.Fatalf("closed unix clients %v", server.ListClients())
+	}
+	//重复关闭
+	server.Shutdown()
+}
@@ -6,6 +6,8 @@ import (
 	"github.com/blackbeans/turbo"
 	"github.com/golang/snappy"
 	"github.com/opentracing/opentracing-go"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +17,14 @@ const (
 	PING = byte(0x03)
 	PONG = byte(0x04)
 	INFO = byte(0x05)
+	//取消进行中的调用
+	CANCEL = byte(0x06)
+	//批量调用,响应为RESP
+	BATCH = byte(0x07)
+	//流式响应的数据帧、结束帧以及调用方的流控确认
+	STREAM     = byte(0x08)
+	STREAM_END = byte(0x09)
+	STREAM_ACK = byte(0x0A)
 )
 
 const (
@@ -75,12 +85,39 @@ func (self BinaryCodec) UnmarshalPayload(p *turbo.Packet) (interface{}, error) {
 			req.CreateTime = time.Now().UnixNano() / int64(time.Millisecond)
 		}
 		p.PayLoad = *req
+	} else if p.Header.CmdType == BATCH {
+		//batch
+		var batch MoaRawBatchReqPacket
+		err := json.Unmarshal(p.Data, &batch)
+		if nil != err {
+			return p, err
+		}
+		if batch.CreateTime <= 0 {
+			batch.CreateTime = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		p.PayLoad = batch
 	} else if p.Header.CmdType == PING || p.Header.CmdType == PONG {
 		//ping
 		var ping PiPo
 		json.Unmarshal(p.Data, &ping)
 		p.PayLoad = ping
-	} else if p.Header.CmdType == RESP {
+	} else if p.Header.CmdType == CANCEL {
+		//cancel
+		var cancel MoaCancelPacket
+		err := json.Unmarshal(p.Data, &cancel)
+		if nil != err {
+			return p, err
+		}
+		p.PayLoad = cancel
+	} else if p.Header.CmdType == STREAM_ACK {
+		//stream ack
+		var ack MoaStreamAckPacket
+		err := json.Unmarshal(p.Data, &ack)
+		if nil != err {
+			return p, err
+		}
+		p.PayLoad = ack
+	} else if p.Header.CmdType == RESP || p.Header.CmdType == STREAM || p.Header.CmdType == STREAM_END {
 		//resp
 		resp, err := Wrap2MoaRawResponse(p.Data)
 		if nil != err {
@@ -95,7 +132,7 @@ func (self BinaryCodec) UnmarshalPayload(p *turbo.Packet) (interface{}, error) {
 func (self BinaryCodec) MarshalPayload(p *turbo.Packet) ([]byte, error) {
 
 	var rawPayload []byte
-	if p.Header.CmdType == REQ {
+	if p.Header.CmdType == REQ || p.Header.CmdType == BATCH {
 		data, err := json.Marshal(p.PayLoad)
 		if nil != err {
 			return nil, err
@@ -105,7 +142,10 @@ func (self BinaryCodec) MarshalPayload(p *turbo.Packet) ([]byte, error) {
 	} else if p.Header.CmdType == PING || p.Header.CmdType == PONG {
 		//pong协议
 		rawPayload, _ = json.Marshal(p.PayLoad)
-	} else if p.Header.CmdType == RESP {
+	} else if p.Header.CmdType == CANCEL || p.Header.CmdType == STREAM_ACK {
+		//cancel、stream ack协议
+		rawPayload, _ = json.Marshal(p.PayLoad)
+	} else if p.Header.CmdType == RESP || p.Header.CmdType == STREAM || p.Header.CmdType == STREAM_END {
 
 		resp, ok := p.PayLoad.(MoaRespPacket)
 		if !ok {
@@ -130,6 +170,17 @@ type PiPo struct {
 	Timestamp int64 `json:"timestamp"`
 }
 
+//取消调用,Opaque为需要取消的请求的Opaque
+type MoaCancelPacket struct {
+	Opaque uint32 `json:"opaque"`
+}
+
+//流式响应的流控确认,Credits为调用方还可以接收的帧数
+type MoaStreamAckPacket struct {
+	Opaque  uint32 `json:"opaque"`
+	Credits int32  `json:"credits"`
+}
+
 type MoaReqPacket struct {
 	ServiceUri string `json:"action"`
 	Params     struct {
@@ -154,12 +205,25 @@ type MoaRawReqPacket struct {
 	Source     string            `json:"-"`
 }
 
+//批量调用的包
+type MoaBatchReqPacket struct {
+	Requests []MoaReqPacket `json:"reqs"`
+}
+
+//批量调用的包,每个调用单独计算超时
+type MoaRawBatchReqPacket struct {
+	Requests   []MoaRawReqPacket `json:"reqs"`
+	CreateTime int64             `json:"-"` //创建时间 ms
+}
+
 //moa响应packet
 type MoaRespPacket struct {
 	ErrCode    int         `json:"ec"`
 	Message    string      `json:"em"`
 	CreateTime int64       `json:"-"` //创建时间 ms
 	Result     interface{} `json:"result"`
+	//MoaError的附加信息
+	Details interface{} `json:"details,omitempty"`
 }
 
 //moa响应packet
@@ -168,6 +232,8 @@ type MoaRawRespPacket struct {
 	Message    string          `json:"em"`
 	CreateTime int64           `json:"-"` //创建时间 ms
 	Result     json.RawMessage `json:"result"`
+	//MoaError的附加信息
+	Details json.RawMessage `json:"details,omitempty"`
 }
 
 func Wrap2MoaRawRequest(data []byte) (*MoaRawReqPacket, error) {
@@ -193,11 +259,41 @@ func Wrap2MoaRawResponse(data []byte) (*MoaRawRespPacket, error) {
 const (
 	KEY_MOA_PROPERTIES = "moa.props"
 
+	//调用方取消调用的标记
+	KEY_MOA_CANCEL = "moa.cancel"
+
 	//MOA节点选择hash值
 	KEY_MOA_PROPERTY_HASHID = "hashid"
 
 	//MOA的调用环境，可以一直带到整个调用链结束
 	KEY_MOA_PROPERTY_ENV_PRE = "moa.env.pre"
+
+	//流式响应的初始流控窗口大小
+	KEY_MOA_PROPERTY_STREAM_WINDOW = "moa.stream.window"
+
+	//调用的服务分组，action中没有带#groupId时使用
+	KEY_MOA_PROPERTY_GROUP = "moa.group"
+
+	//调用方的截止时间 unix ms，服务端取min(调用方截止时间,服务端超时)，嵌套调用继续传递
+	KEY_MOA_PROPERTY_DEADLINE = "moa.deadline"
+
+	//调用方的应用名称，用于限流、认证等按调用方区分的策略
+	KEY_MOA_PROPERTY_APP = "moa.app"
+
+	//调用方签名的时间戳 unix ms
+	KEY_MOA_PROPERTY_TIMESTAMP = "moa.timestamp"
+
+	//调用方签名的随机数，同一个签名只能使用一次
+	KEY_MOA_PROPERTY_NONCE = "moa.nonce"
+
+	//调用方的签名
+	KEY_MOA_PROPERTY_SIGNATURE = "moa.signature"
+
+	//认证通过的调用方
+	KEY_MOA_CALLER = "moa.caller"
+
+	//调用的幂等key，开启幂等的方法在窗口期内相同key只执行一次
+	KEY_MOA_PROPERTY_IDEMPOTENCY_KEY = "moa.idempotency.key"
 )
 
 //切记切记。在使用完之后要做移除。否则会造成内存泄露
@@ -239,6 +335,70 @@ func GetMoaProperty(ctx context.Context, key string) (string, bool) {
 	return "", false
 }
 
+//认证通过的调用方app,没有开启认证则不存在
+func GetMoaCaller(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(KEY_MOA_CALLER).(string)
+	return caller, ok && len(caller) > 0
+}
+
+func withMoaCaller(ctx context.Context, caller string) context.Context {
+	if len(caller) <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, KEY_MOA_CALLER, caller)
+}
+
+//设置调用的截止时间
+func WithMoaDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return AttachMoaProperty(ctx, KEY_MOA_PROPERTY_DEADLINE, formatMoaDeadline(deadline))
+}
+
+//获取调用方的截止时间
+func GetMoaDeadline(ctx context.Context) (time.Time, bool) {
+	val, ok := GetMoaProperty(ctx, KEY_MOA_PROPERTY_DEADLINE)
+	if !ok {
+		return time.Time{}, false
+	}
+	return parseMoaDeadline(val)
+}
+
+func formatMoaDeadline(deadline time.Time) string {
+	return strconv.FormatInt(deadline.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func parseMoaDeadline(val string) (time.Time, bool) {
+	ms, err := strconv.ParseInt(val, 10, 64)
+	if nil != err || ms <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+//调用方主动取消
+type userCancel struct {
+	cancelled int32
+	cancel    context.CancelFunc
+}
+
+func withUserCancel(ctx context.Context) (context.Context, *userCancel) {
+	cctx, cancel := context.WithCancel(ctx)
+	uc := &userCancel{cancel: cancel}
+	return context.WithValue(cctx, KEY_MOA_CANCEL, uc), uc
+}
+
+func (self *userCancel) Cancel() {
+	atomic.StoreInt32(&self.cancelled, 1)
+	self.cancel()
+}
+
+//调用是否已经被调用方通过CANCEL取消
+func IsUserCancelled(ctx context.Context) bool {
+	if uc, ok := ctx.Value(KEY_MOA_CANCEL).(*userCancel); ok {
+		return atomic.LoadInt32(&uc.cancelled) == 1
+	}
+	return false
+}
+
 // 从我们的 Context 中获取 SpanContext，如果没有则返回 nil
 // 其实是从 context 的 moa.props 中获取信息
 func GetSpanCtx(ctx context.Context) opentracing.SpanContext {
@@ -2,9 +2,13 @@ package core
 
 import (
 	_ "bytes"
+	"context"
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/blackbeans/turbo"
 )
 
 type ParamsTmp struct {
@@ -46,3 +50,36 @@ func BenchmarkUnmarshal(t *testing.B) {
 	t.Log(inst.Elem().Interface())
 
 }
+
+func TestMoaDeadline(t *testing.T) {
+	if _, ok := GetMoaDeadline(context.TODO()); ok {
+		t.Fatal("deadline should not exist")
+	}
+	deadline := time.Now().Add(time.Second).Truncate(time.Millisecond)
+	ctx := WithMoaDeadline(context.TODO(), deadline)
+	if d, ok := GetMoaDeadline(ctx); !ok || !d.Equal(deadline) {
+		t.Fatalf("GetMoaDeadline %s|%s", d, deadline)
+	}
+	if _, ok := parseMoaDeadline("abc"); ok {
+		t.Fatal("invalid deadline should fail")
+	}
+}
+
+func TestCancelCodec(t *testing.T) {
+	codec := BinaryCodec{}
+	p := turbo.NewPacket(CANCEL, nil)
+	p.PayLoad = MoaCancelPacket{Opaque: 100}
+	data, err := codec.MarshalPayload(p)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	p = turbo.NewPacket(CANCEL, data)
+	payload, err := codec.UnmarshalPayload(p)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if cancel, ok := payload.(MoaCancelPacket); !ok || cancel.Opaque != 100 {
+		t.Fatalf("TestCancelCodec|%v", payload)
+	}
+}
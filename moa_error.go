@@ -0,0 +1,42 @@
+package core
+
+import "fmt"
+
+//业务错误
+//服务方法返回MoaError时,错误码、错误信息以及details会原样返回给调用方
+//普通的error保持原有的行为
+type MoaError interface {
+	error
+	//错误码,不要和框架的错误码冲突
+	ErrCode() int
+	ErrMessage() string
+	//附加的错误信息,可以为nil
+	ErrDetails() interface{}
+}
+
+//MoaError的默认实现
+type BizError struct {
+	Code    int
+	Message string
+	Details interface{}
+}
+
+func NewMoaError(code int, message string, details interface{}) *BizError {
+	return &BizError{Code: code, Message: message, Details: details}
+}
+
+func (self *BizError) Error() string {
+	return fmt.Sprintf(MSG_MESSAGE, self.Code, self.Message)
+}
+
+func (self *BizError) ErrCode() int {
+	return self.Code
+}
+
+func (self *BizError) ErrMessage() string {
+	return self.Message
+}
+
+func (self *BizError) ErrDetails() interface{} {
+	return self.Details
+}
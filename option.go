@@ -1,6 +1,8 @@
 package core
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
@@ -31,6 +33,25 @@ type Option struct {
 		BindAddress string
 		Compress    string // compres=snappy
 		IsPre       bool   // 是否是预发布环境
+		//关闭时等待处理中请求完成的最长时间 10 s单位
+		ShutdownTimeout time.Duration
+		//额外的监听地址,不发布到注册中心 tcp://:13100 unix:///var/run/moa.sock
+		Listeners []string
+	}
+
+	//admin http配置
+	Admin struct {
+		Disabled bool   //是否关闭admin server
+		Address  string //监听地址,默认BindAddress端口+1000
+		User     string //basic auth 用户名,为空则不校验
+		Password string //basic auth 密码
+	}
+
+	//调用方认证
+	Auth struct {
+		Enabled bool              //是否开启认证
+		Window  time.Duration     //签名时间戳允许的偏差 300 s单位
+		Keys    map[string]string //app对应的密钥
 	}
 
 	//client配置
@@ -41,6 +62,10 @@ type Option struct {
 		SlowLog          *bool  //是否打开slowlog ,默认打开
 	}
 	Clusters map[string]Cluster //各集群的配置
+	//服务端限流规则,可以热更新
+	RateLimits []RateLimit
+	//服务的访问控制,和注册中心下发的合并生效,可以热更新
+	AccessControls []AccessControl
 }
 
 //----------------------------------------
@@ -56,6 +81,7 @@ type Cluster struct {
 	WriteChannelSize  int           //=1000 //写异步channel长度
 	ReadChannelSize   int           //=1000 //读异步channel长度
 	FutureSize        int           //默认值 100 * 10000  //请求响应的容量
+	SlowLogThreshold  time.Duration //慢调用日志阈值 1000 ms单位
 }
 
 func LoadConfiguration(path string) (Option, error) {
@@ -66,7 +92,7 @@ func LoadConfiguration(path string) (Option, error) {
 	defer f.Close()
 	buff, rerr := ioutil.ReadAll(f)
 	if nil != rerr {
-		return Option{}, err
+		return Option{}, rerr
 	}
 
 	//读取配置
@@ -76,12 +102,43 @@ func LoadConfiguration(path string) (Option, error) {
 		return Option{}, err
 	}
 
+	//配置文件中的时间单位均为秒
+	option.Server.ShutdownTimeout =
+		time.Duration(int64(option.Server.ShutdownTimeout) * int64(time.Second))
+	option.Auth.Window =
+		time.Duration(int64(option.Auth.Window) * int64(time.Second))
+	for name, cluster := range option.Clusters {
+		cluster.IdleTimeout =
+			time.Duration(int64(cluster.IdleTimeout) * int64(time.Second))
+		cluster.ProcessTimeout =
+			time.Duration(int64(cluster.ProcessTimeout) * int64(time.Second))
+		cluster.SlowLogThreshold =
+			time.Duration(int64(cluster.SlowLogThreshold) * int64(time.Millisecond))
+		option.Clusters[name] = cluster
+	}
+	return fillDefaults(option), nil
+
+}
+
+//设置默认值,时间类的配置已经是time.Duration
+func fillDefaults(option Option) Option {
 	slowlog := true
 	if nil != option.Client.SlowLog {
 		slowlog = *(option.Client.SlowLog)
 
 	}
 	option.Client.SlowLog = &slowlog
+
+	//关闭时等待处理中请求的时间
+	if option.Server.ShutdownTimeout <= 0 {
+		option.Server.ShutdownTimeout = 10 * time.Second
+	}
+
+	//签名时间戳允许的偏差
+	if option.Auth.Window <= 0 {
+		option.Auth.Window = DEFAULT_AUTH_WINDOW
+	}
+
 	clusters := make(map[string]Cluster, len(option.Clusters))
 	//设置默认值
 	for name, cluster := range option.Clusters {
@@ -107,13 +164,16 @@ func LoadConfiguration(path string) (Option, error) {
 
 		//链接空闲时间
 		if cluster.IdleTimeout <= 0 {
-			cluster.IdleTimeout = 5 * 60
+			cluster.IdleTimeout = 5 * 60 * time.Second
 		}
 
-		cluster.IdleTimeout =
-			time.Duration(int64(cluster.IdleTimeout) * int64(time.Second))
 		if cluster.ProcessTimeout <= 0 {
-			cluster.ProcessTimeout = 5
+			cluster.ProcessTimeout = 5 * time.Second
+		}
+
+		//慢调用日志
+		if cluster.SlowLogThreshold <= 0 {
+			cluster.SlowLogThreshold = 1000 * time.Millisecond
 		}
 
 		//工作池子
@@ -124,14 +184,10 @@ func LoadConfiguration(path string) (Option, error) {
 		if cluster.FutureSize <= 100*10000 {
 			cluster.FutureSize = 100 * 10000
 		}
-
-		cluster.ProcessTimeout =
-			time.Duration(int64(cluster.ProcessTimeout) * int64(time.Second))
 		clusters[name] = cluster
 	}
 	option.Clusters = clusters
-	return option, nil
-
+	return option
 }
 
 //初始化客户端的Option
@@ -166,13 +222,25 @@ func InitClientOption(option Option) Option {
 
 //初始化server的配置
 func InitServerOption(option Option) Option {
+	op, err := initServerOption(option)
+	if nil != err {
+		panic(err.Error())
+	}
+	return op
+}
+
+//初始化server的配置,配置错误时返回error
+func initServerOption(option Option) (Option, error) {
 	//------------寻找匹配的网卡IP段，进行匹配
 	split := strings.Split(option.Server.BindAddress, ":")
+	if len(split) != 2 {
+		return option, fmt.Errorf("Server BindAddress Invalid! [%s]", option.Server.BindAddress)
+	}
 	regx := split[0]
 
 	inters, err := net.Interfaces()
 	if nil != err {
-		panic(err)
+		return option, err
 	} else {
 		hasMatched := false
 		//如果没有IP匹配表达式则用默认的
@@ -236,9 +304,9 @@ func InitServerOption(option Option) Option {
 			option.Server.Compress = "snappy"
 		}
 	} else {
-		panic("Server RunMode Conf Not Found!")
+		return option, errors.New("Server RunMode Conf Not Found!")
 	}
 
 	option.Clusters[option.Server.RunMode] = cluster
-	return option
+	return option, nil
 }
@@ -2,15 +2,15 @@ package core
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blackbeans/turbo"
-	"github.com/opentracing/opentracing-go"
 )
 
 type MethodMeta struct {
@@ -18,6 +18,24 @@ type MethodMeta struct {
 	Method     reflect.Value
 	ReturnType []reflect.Type
 	ParamTypes []reflect.Type
+	//最后一个参数是否为可变参数
+	Variadic bool
+	//返回(<-chan T, error)的流式方法
+	Stream bool
+	//方法的并发限制,nil为不限制
+	bulkhead *Bulkhead
+	//方法的结果缓存,nil为不缓存
+	cache *resultCache
+	//合并相同参数的并发调用,nil为不合并
+	flight *singleflight
+	//按照幂等key去重的调用,nil为不去重
+	idempotency *idempotencyStore
+	//方法的处理超时,为0时使用集群的ProcessTimeout
+	Timeout time.Duration
+	//第一个参数是否为context.Context
+	withContext bool
+	//除context外每个参数的解码器,可变参数为元素类型的解码器
+	decoders []argDecoder
 }
 
 type ServiceMeta struct {
@@ -34,6 +52,29 @@ type Service struct {
 	IsPre      bool        `json:"isPre"`       //是否是预发环境
 	Interface  interface{} `json:"-"`
 	Instance   interface{} `json:"-"`
+	//服务的处理超时,为0时使用集群的ProcessTimeout
+	Timeout time.Duration `json:"-"`
+	//方法级别的处理超时,key为方法名或者别名不区分大小写,优先于Timeout
+	MethodTimeouts map[string]time.Duration `json:"-"`
+	//默认为Java兼容的严格模式:不支持可变参数,返回值最多2个并且最后一个为error
+	//Relaxed为true时支持可变参数、流式结果,多个返回值以JSON数组返回,只供Go的调用方使用
+	Relaxed bool `json:"-"`
+	//方法别名 key:Go方法名 value:对外的方法名,配置别名后只能通过别名调用
+	MethodAliases map[string]string `json:"-"`
+	//服务的最大并发数,超过直接返回CODE_THREAD_POOL_IS_FULL,0为不限制
+	MaxConcurrency int `json:"-"`
+	//方法级别的最大并发数,key为方法名或者别名不区分大小写
+	MethodMaxConcurrency map[string]int `json:"-"`
+	//方法的结果缓存,key为方法名或者别名不区分大小写
+	MethodCaches map[string]MethodCache `json:"-"`
+	//相同参数的并发调用只执行一次并共享结果,key为方法名或者别名不区分大小写
+	MethodSingleflight map[string]bool `json:"-"`
+	//按照属性moa.idempotency.key去重的方法以及记录响应的窗口,key为方法名或者别名不区分大小写
+	MethodIdempotency map[string]time.Duration `json:"-"`
+	//interface{}、map[string]interface{}等参数中的数字解码为json.Number而不是float64,避免64位ID丢失精度
+	UseNumber bool `json:"-"`
+	//服务的并发限制
+	bulkhead *Bulkhead
 	//方法名称反射对应的方法
 	methods map[string]MethodMeta
 
@@ -41,76 +82,434 @@ type Service struct {
 }
 
 type InvocationHandler struct {
+	//慢调用日志阈值 ns
+	slowThreshold int64
+	//默认的处理超时 ns,服务和方法没有配置时使用
+	processTimeout int64
+	//copy on write,运行时增删服务
 	instances map[string]Service
+	lock      sync.RWMutex
 	moaStat   *MoaStat
+	//用户注册的拦截器
+	interceptors []Interceptor
+	//内置拦截器+用户拦截器组装后的调用链
+	chain Invoker
 }
 
 var errorType = reflect.TypeOf(make([]error, 1)).Elem()
 
 func NewInvocationHandler(services []Service, moaStat *MoaStat) *InvocationHandler {
+	handler, err := newInvocationHandler(services, moaStat)
+	if nil != err {
+		panic(err)
+	}
+	return handler
+}
+
+//反射服务的方法,服务定义不合法时返回error
+func newInvocationHandler(services []Service, moaStat *MoaStat) (*InvocationHandler, error) {
 	instances := make(map[string]Service, len(services))
 	//对instace进行反射获得方法
 	for _, s := range services {
-		inter := reflect.TypeOf(s.Interface).Elem()
-		rv := reflect.ValueOf(s.Instance)
-		v := reflect.TypeOf(s.Instance)
-		impl := v.Implements(inter)
-		if !impl {
-			panic(fmt.Sprintf("InvocationHandler|Not Implements|%s|%s",
-				v.String(), inter.String()))
-		}
-		numMethod := inter.NumMethod()
-		s.methods = make(map[string]MethodMeta, numMethod)
-		for i := 0; i < numMethod; i++ {
-			mm := MethodMeta{}
-			m := inter.Method(i)
-			im := rv.MethodByName(m.Name)
-			mm.Method = im
-			mm.Name = m.Name
-			t := m.Type
-			fn := t.NumIn()
-			outType := make([]reflect.Type, 0, 2)
-			for idx := 0; idx < t.NumOut(); idx++ {
-				outType = append(outType, t.Out(idx))
+		service, err := buildService(s)
+		if nil != err {
+			return nil, err
+		}
+		key := BuildServiceUri(service.ServiceUri, service.GroupId)
+		if _, ok := instances[key]; ok {
+			return nil, fmt.Errorf("InvocationHandler|InitService|Already Exists|%s|%s", service.ServiceUri, service.GroupId)
+		}
+		instances[key] = service
+		log.Infof("NewInvocationHandler|InitService|SUCC|%s|%s", s.ServiceUri, service.GroupId)
+	}
+	handler := &InvocationHandler{instances: instances,
+		moaStat:        moaStat,
+		slowThreshold:  int64(1000 * time.Millisecond),
+		processTimeout: int64(5 * time.Second)}
+	handler.chain = handler.buildChain()
+	return handler, nil
+
+}
+
+//反射服务实例的方法
+func buildService(s Service) (Service, error) {
+	if nil == s.Interface || nil == s.Instance {
+		return s, fmt.Errorf("InvocationHandler|Interface Or Instance Is Nil|%s", s.ServiceUri)
+	}
+	//服务分默认不配置是使用*分组
+	if len(s.GroupId) <= 0 {
+		s.GroupId = "*"
+	}
+	inter := reflect.TypeOf(s.Interface).Elem()
+	rv := reflect.ValueOf(s.Instance)
+	v := reflect.TypeOf(s.Instance)
+	impl := v.Implements(inter)
+	//方法定义在指针上,使用实例的指针
+	if !impl && v.Kind() != reflect.Ptr && reflect.PtrTo(v).Implements(inter) {
+		ptr := reflect.New(v)
+		ptr.Elem().Set(rv)
+		rv = ptr
+		impl = true
+	}
+	if !impl {
+		return s, fmt.Errorf("InvocationHandler|Not Implements|%s|%s",
+			v.String(), inter.String())
+	}
+	if s.Timeout < 0 {
+		return s, fmt.Errorf("InvocationHandler|Timeout Invalid|%s|%s", s.ServiceUri, s.Timeout)
+	}
+	methodTimeouts := make(map[string]time.Duration, len(s.MethodTimeouts))
+	for name, timeout := range s.MethodTimeouts {
+		if timeout < 0 {
+			return s, fmt.Errorf("InvocationHandler|Method Timeout Invalid|%s|%s|%s", s.ServiceUri, name, timeout)
+		}
+		methodTimeouts[strings.ToLower(name)] = timeout
+	}
+	if s.MaxConcurrency < 0 {
+		return s, fmt.Errorf("InvocationHandler|MaxConcurrency Invalid|%s|%d", s.ServiceUri, s.MaxConcurrency)
+	}
+	methodConcurrency := make(map[string]int, len(s.MethodMaxConcurrency))
+	for name, limit := range s.MethodMaxConcurrency {
+		if limit < 0 {
+			return s, fmt.Errorf("InvocationHandler|Method MaxConcurrency Invalid|%s|%s|%d", s.ServiceUri, name, limit)
+		}
+		methodConcurrency[strings.ToLower(name)] = limit
+	}
+	methodCaches := make(map[string]MethodCache, len(s.MethodCaches))
+	for name, c := range s.MethodCaches {
+		if c.TTL <= 0 || c.MaxEntries < 0 {
+			return s, fmt.Errorf("InvocationHandler|Method Cache Invalid|%s|%s|%v", s.ServiceUri, name, c)
+		}
+		methodCaches[strings.ToLower(name)] = c
+	}
+	methodFlights := make(map[string]bool, len(s.MethodSingleflight))
+	for name, enabled := range s.MethodSingleflight {
+		methodFlights[strings.ToLower(name)] = enabled
+	}
+	methodIdempotency := make(map[string]time.Duration, len(s.MethodIdempotency))
+	for name, window := range s.MethodIdempotency {
+		if window <= 0 {
+			return s, fmt.Errorf("InvocationHandler|Method Idempotency Window Invalid|%s|%s|%s", s.ServiceUri, name, window)
+		}
+		methodIdempotency[strings.ToLower(name)] = window
+	}
+	s.bulkhead = newBulkhead(s.MaxConcurrency)
+	for name, alias := range s.MethodAliases {
+		if _, ok := inter.MethodByName(name); !ok {
+			return s, fmt.Errorf("InvocationHandler|Method Alias Not Found|%s|%s", s.ServiceUri, name)
+		}
+		if len(alias) <= 0 {
+			return s, fmt.Errorf("InvocationHandler|Method Alias Is Empty|%s|%s", s.ServiceUri, name)
+		}
+	}
+	numMethod := inter.NumMethod()
+	s.methods = make(map[string]MethodMeta, numMethod)
+	for i := 0; i < numMethod; i++ {
+		mm := MethodMeta{}
+		m := inter.Method(i)
+		im := rv.MethodByName(m.Name)
+		mm.Method = im
+		//对外的方法名
+		mm.Name = m.Name
+		if alias, ok := s.MethodAliases[m.Name]; ok {
+			mm.Name = alias
+		}
+		key := strings.ToLower(mm.Name)
+		//方法名不区分大小写,别名或者方法名冲突时返回错误
+		if exist, ok := s.methods[key]; ok {
+			return s, fmt.Errorf("InvocationHandler|Method Name Conflict|%s|%s|%s",
+				s.ServiceUri, exist.Name, mm.Name)
+		}
+		//方法超时优先,其次服务超时
+		mm.Timeout = s.Timeout
+		for _, name := range []string{key, strings.ToLower(m.Name)} {
+			if timeout, ok := methodTimeouts[name]; ok {
+				mm.Timeout = timeout
+				delete(methodTimeouts, name)
 			}
-			//返回值必须大于等于1个并且小于2，并且其中一个必须为error类型
-			if t.NumOut() >= 1 && t.NumOut() <= 2 {
-				if !t.Out(t.NumOut() - 1).Implements(errorType) {
-					panic(
-						fmt.Errorf("%s Method  %s Last Return Type Must Be An Error! [%s]",
-							s.ServiceUri, m.Name, t.Out(t.NumOut()-1).String()))
+			if limit, ok := methodConcurrency[name]; ok {
+				mm.bulkhead = newBulkhead(limit)
+				delete(methodConcurrency, name)
+			}
+			if c, ok := methodCaches[name]; ok {
+				mm.cache = newResultCache(c)
+				delete(methodCaches, name)
+			}
+			if enabled, ok := methodFlights[name]; ok {
+				if enabled {
+					mm.flight = newSingleflight()
 				}
-			} else {
-				panic(
-					fmt.Errorf("%s Method  %s Last Return Count (1<=n<=2) Type "+
-						"Must Be More Than An Error! ",
-						s.ServiceUri, m.Name))
+				delete(methodFlights, name)
+			}
+			if window, ok := methodIdempotency[name]; ok {
+				mm.idempotency = newIdempotencyStore(window)
+				delete(methodIdempotency, name)
+			}
+		}
+		t := m.Type
+		fn := t.NumIn()
+		outType := make([]reflect.Type, 0, 2)
+		for idx := 0; idx < t.NumOut(); idx++ {
+			outType = append(outType, t.Out(idx))
+		}
+		if !s.Relaxed {
+			//返回值必须大于等于1个并且小于2，并且其中一个必须为error类型
+			if t.NumOut() < 1 || t.NumOut() > 2 {
+				return s, fmt.Errorf("%s Method  %s Last Return Count (1<=n<=2) Type "+
+					"Must Be More Than An Error! ",
+					s.ServiceUri, m.Name)
 			}
-			mm.ReturnType = outType
-			mm.ParamTypes = make([]reflect.Type, 0, fn)
-			for j := 0; j < fn; j++ {
-				f := t.In(j)
-				mm.ParamTypes = append(mm.ParamTypes, f)
+			if t.IsVariadic() {
+				return s, fmt.Errorf("%s Method  %s Variadic Params Not Supported In Strict Mode!",
+					s.ServiceUri, m.Name)
 			}
-			s.methods[strings.ToLower(m.Name)] = mm
-			//单个客户端调用的情况
-			s.InvokesPerClient = &sync.Map{}
+		} else if t.NumOut() < 1 {
+			return s, fmt.Errorf("%s Method  %s Return Count (n>=1) Type "+
+				"Must Be More Than An Error! ",
+				s.ServiceUri, m.Name)
+		}
+		if !t.Out(t.NumOut() - 1).Implements(errorType) {
+			return s, fmt.Errorf("%s Method  %s Last Return Type Must Be An Error! [%s]",
+				s.ServiceUri, m.Name, t.Out(t.NumOut()-1).String())
+		}
+		mm.ReturnType = outType
+		mm.Variadic = t.IsVariadic()
+		mm.Stream = t.NumOut() == 2 && t.Out(0).Kind() == reflect.Chan && t.Out(0).ChanDir() == reflect.RecvDir
+		if mm.Stream && !s.Relaxed {
+			return s, fmt.Errorf("%s Method  %s Stream Result Not Supported In Strict Mode!",
+				s.ServiceUri, m.Name)
+		}
+		if mm.Stream && nil != mm.cache {
+			return s, fmt.Errorf("%s Method  %s Stream Result Can Not Be Cached!",
+				s.ServiceUri, m.Name)
+		}
+		if mm.Stream && (nil != mm.flight || nil != mm.idempotency) {
+			return s, fmt.Errorf("%s Method  %s Stream Result Can Not Be Shared!",
+				s.ServiceUri, m.Name)
 		}
-		instances[s.ServiceUri] = s
-		log.Infof("NewInvocationHandler|InitService|SUCC|%s", s.ServiceUri)
+		mm.ParamTypes = make([]reflect.Type, 0, fn)
+		for j := 0; j < fn; j++ {
+			f := t.In(j)
+			mm.ParamTypes = append(mm.ParamTypes, f)
+		}
+		buildDecoders(&mm, s.UseNumber)
+		s.methods[key] = mm
+	}
+	//配置了不存在的方法,避免方法名写错而不生效
+	for _, c := range []struct {
+		config  string
+		methods interface{}
+	}{
+		{"Timeout", methodTimeouts},
+		{"MaxConcurrency", methodConcurrency},
+		{"Cache", methodCaches},
+		{"Singleflight", methodFlights},
+		{"Idempotency", methodIdempotency},
+	} {
+		if err := methodsNotFound(s.ServiceUri, c.config, c.methods); nil != err {
+			return s, err
+		}
+	}
+	//单个客户端调用的情况
+	s.InvokesPerClient = &sync.Map{}
+	return s, nil
+}
+
+//方法级别的配置中没有匹配到方法的名称,methods为方法名到配置的map
+func methodsNotFound(serviceUri, config string, methods interface{}) error {
+	keys := reflect.ValueOf(methods).MapKeys()
+	if len(keys) <= 0 {
+		return nil
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.String())
+	}
+	sort.Strings(names)
+	return fmt.Errorf("InvocationHandler|Method %s Not Found|%s|%v", config, serviceUri, names)
+}
+
+//运行时发布服务
+func (self *InvocationHandler) AddService(s Service) error {
+	service, err := buildService(s)
+	if nil != err {
+		return err
+	}
+
+	key := BuildServiceUri(service.ServiceUri, service.GroupId)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.instances[key]; ok {
+		return fmt.Errorf("InvocationHandler|AddService|Already Exists|%s|%s", service.ServiceUri, service.GroupId)
+	}
+	//copy on write 不影响正在遍历的调用方
+	instances := make(map[string]Service, len(self.instances)+1)
+	for k, inst := range self.instances {
+		instances[k] = inst
+	}
+	instances[key] = service
+	self.instances = instances
+	log.Infof("InvocationHandler|AddService|SUCC|%s|%s", service.ServiceUri, service.GroupId)
+	return nil
+}
+
+//运行时下线服务,serviceUri#groupId只下线该分组,否则下线所有分组
+func (self *InvocationHandler) RemoveService(serviceUri string) bool {
+	return self.removeServices(func(s Service) bool {
+		return matchService(s, serviceUri)
+	})
+}
+
+//下线指定分组的服务
+func (self *InvocationHandler) removeService(serviceUri, groupId string) bool {
+	return self.removeServices(func(s Service) bool {
+		return s.ServiceUri == serviceUri && s.GroupId == groupId
+	})
+}
+
+func (self *InvocationHandler) removeServices(match func(s Service) bool) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	found := false
+	instances := make(map[string]Service, len(self.instances))
+	for k, inst := range self.instances {
+		if match(inst) {
+			found = true
+			log.Infof("InvocationHandler|RemoveService|SUCC|%s|%s", inst.ServiceUri, inst.GroupId)
+			continue
+		}
+		instances[k] = inst
+	}
+	if found {
+		self.instances = instances
+	}
+	return found
+}
+
+//serviceUri#groupId匹配该分组,serviceUri匹配所有分组
+func matchService(s Service, serviceUri string) bool {
+	if strings.Contains(serviceUri, "#") {
+		uri, groupId := UnwrapServiceUri(serviceUri)
+		return s.ServiceUri == uri && s.GroupId == groupId
+	}
+	return s.ServiceUri == serviceUri
+}
+
+//请求的服务和分组,action为serviceUri#groupId或者通过moa.group属性指定分组
+func requestServiceUri(action string, props map[string]string) (string, string) {
+	serviceUri, groupId := UnwrapServiceUri(action)
+	if "*" == groupId {
+		if g, ok := props[KEY_MOA_PROPERTY_GROUP]; ok && len(g) > 0 {
+			groupId = g
+		}
+	}
+	return serviceUri, groupId
+}
+
+//获取服务,serviceUri可以带#groupId
+func (self *InvocationHandler) getService(serviceUri string) (Service, bool) {
+	uri, groupId := UnwrapServiceUri(serviceUri)
+	return self.lookupService(uri, groupId)
+}
+
+//按照服务和分组查找
+//没有该分组时使用*分组,没有指定分组并且只发布了一个分组时使用该分组
+func (self *InvocationHandler) lookupService(serviceUri, groupId string) (Service, bool) {
+	self.lock.RLock()
+	instances := self.instances
+	self.lock.RUnlock()
+
+	if s, ok := instances[BuildServiceUri(serviceUri, groupId)]; ok {
+		return s, true
+	}
+	if s, ok := instances[serviceUri]; ok {
+		return s, true
+	}
+	if "*" == groupId {
+		var found Service
+		count := 0
+		for _, s := range instances {
+			if s.ServiceUri == serviceUri {
+				found = s
+				count++
+			}
+		}
+		if count == 1 {
+			return found, true
+		}
+	}
+	return Service{}, false
+}
+
+//按照分发的规则解析请求实际调用的服务和分组,没有找到则返回请求的服务和分组
+func (self *InvocationHandler) resolveService(serviceUri, groupId string) (string, string) {
+	if s, ok := self.lookupService(serviceUri, groupId); ok {
+		return s.ServiceUri, s.GroupId
 	}
-	return &InvocationHandler{instances: instances,
-		moaStat: moaStat}
+	return serviceUri, groupId
+}
 
+//请求的方法是否为流式方法
+func (self *InvocationHandler) isStream(serviceUri, groupId, method string) bool {
+	s, ok := self.lookupService(serviceUri, groupId)
+	if !ok {
+		return false
+	}
+	return s.methods[strings.ToLower(method)].Stream
 }
 
-//服务调用情况
-func (self InvocationHandler) ListInvokes(servicename string) []InvokePerClient {
+//当前发布的所有服务,只读
+func (self *InvocationHandler) Services() map[string]Service {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.instances
+}
 
-	service, ok := self.instances[servicename]
+//设置慢调用日志的阈值,支持热更新
+func (self *InvocationHandler) SetSlowLogThreshold(threshold time.Duration) {
+	if threshold > 0 {
+		atomic.StoreInt64(&self.slowThreshold, int64(threshold))
+	}
+}
+
+//设置默认的处理超时,支持热更新
+func (self *InvocationHandler) SetProcessTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		atomic.StoreInt64(&self.processTimeout, int64(timeout))
+	}
+}
+
+//方法的处理超时,方法>服务>集群默认
+func (self *InvocationHandler) ProcessTimeout(serviceUri, method string) time.Duration {
+	if s, ok := self.getService(serviceUri); ok {
+		if m, ok := s.methods[strings.ToLower(method)]; ok && m.Timeout > 0 {
+			return m.Timeout
+		}
+		if s.Timeout > 0 {
+			return s.Timeout
+		}
+	}
+	return time.Duration(atomic.LoadInt64(&self.processTimeout))
+}
+
+//服务调用情况,第一项的client为*,列出所有发布的方法以及所有调用方的调用次数,
+//之后为每个调用方调用过的方法
+func (self *InvocationHandler) ListInvokes(servicename string) []InvokePerClient {
+
+	service, ok := self.getService(servicename)
 	if ok {
-		clients := make([]InvokePerClient, 0, 10)
+		serviceUri := BuildServiceUri(service.ServiceUri, service.GroupId)
+		method := func(name string, count int64) Method {
+			timeout := self.ProcessTimeout(serviceUri, name)
+			bulkhead := service.methods[strings.ToLower(name)].bulkhead
+			return Method{Name: name, Count: count,
+				Timeout:        int64(timeout / time.Millisecond),
+				Concurrency:    bulkhead.Current(),
+				MaxConcurrency: bulkhead.Limit()}
+		}
 
+		totals := make(map[string]int64, len(service.methods))
+		clients := make([]InvokePerClient, 1, 10)
 		service.InvokesPerClient.Range(func(key, value interface{}) bool {
 			s := InvokePerClient{
 				Client:      key.(string),
@@ -119,14 +518,27 @@ func (self InvocationHandler) ListInvokes(servicename string) []InvokePerClient
 			//clientip调用的方法及数量
 			value.(*sync.Map).Range(func(key, value interface{}) bool {
 				methodName := key.(string)
-				count := value.(*turbo.Flow).Count()
-				s.Methods = append(s.Methods, Method{Name: methodName, Count: int64(count)})
+				count := int64(value.(*turbo.Flow).Count())
+				totals[methodName] += count
+				s.Methods = append(s.Methods, method(methodName, count))
 				return true
 			})
 			clients = append(clients, s)
 			return true
 		})
 
+		//没有调用过的方法同样列出生效的超时
+		all := InvokePerClient{
+			Client:      "*",
+			ServiceName: service.ServiceUri,
+			Methods:     make([]Method, 0, len(service.methods))}
+		for _, m := range service.methods {
+			all.Methods = append(all.Methods, method(m.Name, totals[m.Name]))
+		}
+		sort.Slice(all.Methods, func(i, j int) bool {
+			return all.Methods[i].Name < all.Methods[j].Name
+		})
+		clients[0] = all
 		return clients
 	}
 	return []InvokePerClient{}
@@ -135,188 +547,196 @@ func (self InvocationHandler) ListInvokes(servicename string) []InvokePerClient
 var typeOfContext = reflect.TypeOf(new(context.Context)).Elem()
 
 //执行结果
-func (self InvocationHandler) Invoke(ctx context.Context, req MoaRawReqPacket, onCallback func(resp MoaRespPacket) error) {
-
-	// tracing
-	// 请求开始时的一些 set
-	var (
-		isTracing bool
-		childSpan opentracing.Span
-	)
-	parentSpanCtx := GetSpanCtx(ctx) // 从当前的请求中获取 parent span
-	if parentSpanCtx != nil {        // 有parent span时我们才开启child span，否则说明调用端没有开启 tracing
-		isTracing = true
-		childSpan = opentracing.GlobalTracer().StartSpan(req.Params.Method, opentracing.ChildOf(parentSpanCtx)) // 从parent span中生成 child span
-		defer childSpan.Finish()                                                                                // Invoke结束时停止当前span
-		ctx = WithSpanCtx(ctx, childSpan.Context())                                                             // 将 child span 写入 ctx
-
-		// 将入参写到 span log 中
-		for i, arg := range req.Params.Args {
-			v, err := json.Marshal(arg)
-			if err == nil {
-				childSpan.LogKV(fmt.Sprintf("param.%d", i), string(v))
-			}
-		}
-		// 将 moaCtx 有关信息写到 span tag 中
-		if props := ctx.Value(KEY_MOA_PROPERTIES); props != nil {
-			// 从 moa.props 中获取 key value 设置到 child span 的 tag
-			for k, v := range props.(map[string]string) {
-				childSpan.SetTag("moa."+k, v)
-			}
-		}
+func (self *InvocationHandler) Invoke(ctx context.Context, req MoaRawReqPacket, onCallback func(resp MoaRespPacket) error) {
+	resp, timeout := self.call(ctx, req)
+	if timeout {
+		//丢弃结果
+		return
 	}
 
-	self.moaStat.IncrRecv()
-	now := time.Now()
-	resp := MoaRespPacket{}
+	// 根据errCode设置error
+	err := onCallback(resp)
+	if nil != err {
+		log.Errorf("InvocationHandler|Invoke|onCallback|%v|Source:%s|Timeout[%d]ms|%s|%s|%v", err,
+			req.Source, req.Timeout/time.Millisecond, req.ServiceUri, req.Source, req.Params.Method)
+	}
+}
 
-	//捕获运行时异常
-	defer func() {
-		if crash := recover(); nil != crash {
-			self.moaStat.IncrError()
-			resp.ErrCode = CODE_INVOCATION_TARGET
-			resp.Message = fmt.Sprintf(MSG_INVOCATION_TARGET, fmt.Sprintf("%v", crash))
-			log.Errorf("InvocationHandler|Invoke|Panic|%v|Source:%s|Timeout[%d]ms|%s|%s|%v", crash,
-				req.Source, req.Timeout/time.Millisecond, req.ServiceUri, req.Source, req.Params.Method)
-		}
-
-		// 记录耗时
-		cost := time.Now().Sub(now)
-		self.moaStat.MoaMetrics.RpcInvokeDurationSummary.WithLabelValues(req.Params.Method).Observe(cost.Seconds())
-		// 长耗时
-		if cost/time.Millisecond >= 1000 {
-			log.Warnf("InvocationHandler|Invoke|Call|Slow|Source:%s|Cost[%d]ms|%s|%s|%v",
-				req.Source, cost/time.Millisecond, req.ServiceUri, req.Source, req.Params.Method)
-		}
-		// 超时了
-		if cost >= req.Timeout {
-			//丢弃结果
-			log.Warnf("InvocationHandler|Invoke|Call|Source:%s|Timeout[%d]ms|Cost:%d|%s|%s|%v",
-				req.Source, req.Timeout/time.Millisecond, cost/time.Millisecond, req.ServiceUri, req.Source, req.Params.Method)
-		} else {
-			// tracing
-			// 请求响应时的一些 set
-			if isTracing {
-				childSpan.SetTag("resp.ec", resp.ErrCode)
-				childSpan.SetTag("resp.em", resp.Message)
-				rawJson, err := json.Marshal(resp.Result)
-				if err == nil {
-					childSpan.LogKV("resp.result", string(rawJson))
-				}
-				if resp.ErrCode != CODE_SERVER_SUCC {
-					childSpan.SetTag("error", true)
-				}
-			}
+//执行调用,超过处理超时返回true
+func (self *InvocationHandler) call(ctx context.Context, req MoaRawReqPacket) (MoaRespPacket, bool) {
+	serviceUri, groupId := requestServiceUri(req.ServiceUri, req.Properties)
+	invocation := &Invocation{
+		ServiceUri: serviceUri,
+		GroupId:    groupId,
+		Method:     req.Params.Method,
+		Args:       req.Params.Args,
+		Properties: req.Properties,
+		Source:     req.Source,
+		Timeout:    req.Timeout,
+		CreateTime: req.CreateTime,
+	}
 
-			// 根据errCode设置error
-			err := onCallback(resp)
-			if nil != err {
-				log.Errorf("InvocationHandler|Invoke|onCallback|%v|Source:%s|Timeout[%d]ms|%s|%s|%v", err,
-					req.Source, req.Timeout/time.Millisecond, req.ServiceUri, req.Source, req.Params.Method)
-			}
+	now := time.Now()
+	resp := self.invoker()(ctx, invocation)
+	cost := time.Now().Sub(now)
+	// 超时了
+	if cost >= req.Timeout {
+		log.Warnf("InvocationHandler|Invoke|Call|Source:%s|Timeout[%d]ms|Cost:%d|%s|%s|%v",
+			req.Source, req.Timeout/time.Millisecond, cost/time.Millisecond, req.ServiceUri, req.Source, req.Params.Method)
+		//丢弃的流不会再写出
+		if stream, ok := resp.Result.(*ResultStream); ok {
+			stream.close()
 		}
-	}()
+		return resp, true
+	}
+	return resp, false
+}
 
+//拦截器链最内层,反射调用服务的方法
+func (self *InvocationHandler) invoke0(ctx context.Context, invocation *Invocation) MoaRespPacket {
+	resp := MoaRespPacket{}
 	//需要对包的内容解析进行反射调用
-	instance, ok := self.instances[req.ServiceUri]
+	instance, ok := self.lookupService(invocation.ServiceUri, invocation.GroupId)
 	if !ok {
-		self.moaStat.IncrError()
 		resp.ErrCode = CODE_SERVICE_NOT_FOUND
-		resp.Message = fmt.Sprintf(MSG_NO_URI_FOUND, req.ServiceUri)
-	} else {
-		m, mok := instance.methods[strings.ToLower(req.Params.Method)]
-		if !mok {
-			self.moaStat.IncrError()
-			resp.ErrCode = CODE_METHOD_NOT_FOUND
-			resp.Message = fmt.Sprintf(MSG_METHOD_NOT_FOUND, req.Params.Method)
+		resp.Message = fmt.Sprintf(MSG_NO_URI_FOUND, BuildServiceUri(invocation.ServiceUri, invocation.GroupId))
+		return resp
+	}
+
+	m, mok := instance.methods[strings.ToLower(invocation.Method)]
+	if !mok {
+		resp.ErrCode = CODE_METHOD_NOT_FOUND
+		resp.Message = fmt.Sprintf(MSG_METHOD_NOT_FOUND, invocation.Method)
+		return resp
+	}
+
+	countPerMethod, ok := instance.InvokesPerClient.Load(invocation.Source)
+	if !ok {
+		tmp := &sync.Map{}
+		exist, ok := instance.InvokesPerClient.LoadOrStore(invocation.Source, tmp)
+		if !ok {
+			//么有load到则是缓存放入的
+			countPerMethod = tmp
 		} else {
+			countPerMethod = exist
+		}
+	}
+	flow := countPerMethod.(*sync.Map)
+	counter, ok := flow.Load(m.Name)
+	if !ok {
+		tmp := &turbo.Flow{}
+		exist, ok := flow.LoadOrStore(m.Name, tmp)
+		if !ok {
+			counter = tmp
+		} else {
+			counter = exist
+		}
+	}
 
-			countPerMethod, ok := instance.InvokesPerClient.Load(req.Source)
-			if !ok {
-				tmp := &sync.Map{}
-				exist, ok := instance.InvokesPerClient.LoadOrStore(req.Source, tmp)
-				if !ok {
-					//么有load到则是缓存放入的
-					countPerMethod = tmp
-				} else {
-					countPerMethod = exist
-				}
-			}
-			flow := countPerMethod.(*sync.Map)
-			counter, ok := flow.Load(m.Name)
-			if !ok {
-				tmp := &turbo.Flow{}
-				exist, ok := flow.LoadOrStore(m.Name, tmp)
-				if !ok {
-					counter = tmp
-				} else {
-					counter = exist
-				}
-			}
+	counter.(*turbo.Flow).Incr(1)
 
-			counter.(*turbo.Flow).Incr(1)
+	params := make([]reflect.Value, 0, len(m.ParamTypes))
+	//第一个参数是context那么直接使用ctx
+	if m.withContext {
+		params = append(params, reflect.ValueOf(ctx))
+	}
 
-			paramTypes := m.ParamTypes
-			params := make([]reflect.Value, 0, len(m.ParamTypes))
-			if len(m.ParamTypes) > 0 {
-				//第一个参数类型判断下是否是context，如果是那么直接使用ctx
-				if m.ParamTypes[0].Implements(typeOfContext) {
-					params = append(params, reflect.ValueOf(ctx))
-					paramTypes = paramTypes[1:]
-				}
-			}
+	//参数数量不对应,可变参数可以不传
+	if (!m.Variadic && len(invocation.Args) != len(m.decoders)) ||
+		(m.Variadic && len(invocation.Args) < len(m.decoders)-1) {
+		resp.ErrCode = CODE_SERIALIZATION
+		resp.Message = fmt.Sprintf(MSG_PARAMS_NOT_MATCHED,
+			len(invocation.Args), len(m.ParamTypes))
+		return resp
+	}
 
-			//参数数量不对应
-			if len(req.Params.Args) != len(paramTypes) {
-				self.moaStat.IncrError()
-				resp.ErrCode = CODE_SERIALIZATION
-				resp.Message = fmt.Sprintf(MSG_PARAMS_NOT_MATCHED,
-					len(req.Params.Args), len(m.ParamTypes))
-			} else {
-				//参数数量OK逐个转换为reflect.Value类型
-				for i, arg := range req.Params.Args {
-					f := paramTypes[i]
-					inst := reflect.New(f)
-					uerr := json.Unmarshal(arg, inst.Interface())
-					if nil != uerr {
-						resp.ErrCode = CODE_SERIALIZATION_SERVER
-						resp.Message = fmt.Sprintf(MSG_SERIALIZATION, uerr)
-						log.Errorf("InvocationHandler|Invoke|Unmarshal|Source:%s|%s|%s|%s|%v",
-							req.Source, req.ServiceUri, m.Name, string(arg), uerr)
-						break
-					} else {
-						params = append(params, inst.Elem())
-					}
-				}
+	//参数数量OK使用预先生成的解码器逐个转换为reflect.Value类型
+	for i, arg := range invocation.Args {
+		decode := m.decoders[len(m.decoders)-1]
+		if i < len(m.decoders) {
+			decode = m.decoders[i]
+		}
+		v, uerr := decode(arg)
+		if nil != uerr {
+			resp.ErrCode = CODE_SERIALIZATION_SERVER
+			resp.Message = fmt.Sprintf(MSG_SERIALIZATION, uerr)
+			log.Errorf("InvocationHandler|Invoke|Unmarshal|Source:%s|%s|%s|%s|%v",
+				invocation.Source, invocation.ServiceUri, m.Name, string(arg), uerr)
+			return resp
+		}
+		params = append(params, v)
+	}
 
-				if resp.ErrCode != 0 && resp.ErrCode != CODE_SERVER_SUCC {
-					self.moaStat.IncrError()
-				} else {
-					work := invoke(m, params...)
-					if nil != work.err {
-						log.Errorf("InvocationHandler|Invoke|Call|FAIL|%v|Source:%s|%s|%s|%s",
-							work.err, req.Source, req.ServiceUri, m.Name, params)
-						self.moaStat.IncrError()
-						resp.ErrCode = CODE_INVOCATION_TARGET
-						resp.Message = fmt.Sprintf(MSG_INVOCATION_TARGET, work.err)
-					} else if r := work.values; nil != r {
-						self.moaStat.IncrProc()
-						resp.ErrCode = CODE_SERVER_SUCC
-						resp.Result = r[0].Interface()
-						//则肯定会有error
-						if len(r) > 1 && !r[1].IsNil() {
-							resp.Message = fmt.Sprintf("Method Invoke Error %v", r[1].Interface())
-						}
-					} else {
-						//如果为空、说明是取消的任务
-						self.moaStat.IncrError()
-						resp.ErrCode = CODE_INVOCATION_TARGET
-						resp.Message = fmt.Sprintf("NO Result ...")
-					}
-				}
+	work := invoke(m, params...)
+	if nil != work.err {
+		log.Errorf("InvocationHandler|Invoke|Call|FAIL|%v|Source:%s|%s|%s|%s",
+			work.err, invocation.Source, invocation.ServiceUri, m.Name, params)
+		if merr, ok := work.err.(MoaError); ok {
+			wrapMoaError(&resp, merr)
+		} else {
+			resp.ErrCode = CODE_INVOCATION_TARGET
+			resp.Message = fmt.Sprintf(MSG_INVOCATION_TARGET, work.err)
+		}
+	} else if r := work.values; nil != r {
+		resp.ErrCode = CODE_SERVER_SUCC
+		resp.Result = wrapResult(r)
+		//则肯定会有error
+		if last := r[len(r)-1]; len(r) > 1 && !last.IsNil() {
+			if merr, ok := last.Interface().(MoaError); ok {
+				wrapMoaError(&resp, merr)
+			} else {
+				resp.Message = fmt.Sprintf("Method Invoke Error %v", last.Interface())
+			}
+			if m.Stream {
+				//流式方法返回错误则直接响应错误
+				resp.Result = nil
 			}
+		} else if m.Stream {
+			//由调用方写出流式响应
+			resp.Result = &ResultStream{ch: r[0]}
+		}
+	} else {
+		//如果为空、说明是取消的任务
+		resp.ErrCode = CODE_INVOCATION_TARGET
+		resp.Message = fmt.Sprintf("NO Result ...")
+	}
+	return resp
+}
+
+//发布服务时按照参数类型生成解码器,调用时不再逐个判断类型
+func buildDecoders(mm *MethodMeta, useNumber bool) {
+	paramTypes := mm.ParamTypes
+	if len(paramTypes) > 0 && paramTypes[0].Implements(typeOfContext) {
+		mm.withContext = true
+		paramTypes = paramTypes[1:]
+	}
+	mm.decoders = make([]argDecoder, 0, len(paramTypes))
+	for i, f := range paramTypes {
+		if mm.Variadic && i == len(paramTypes)-1 {
+			//可变参数逐个传递
+			f = f.Elem()
 		}
+		mm.decoders = append(mm.decoders, newArgDecoder(f, useNumber))
+	}
+}
+
+//除了error之外的返回值,一个时直接返回,多个时以数组返回
+func wrapResult(values []reflect.Value) interface{} {
+	if len(values) <= 2 {
+		return values[0].Interface()
+	}
+	results := make([]interface{}, 0, len(values)-1)
+	for _, v := range values[:len(values)-1] {
+		results = append(results, v.Interface())
 	}
+	return results
+}
+
+//业务错误的错误码、信息返回给调用方
+func wrapMoaError(resp *MoaRespPacket, merr MoaError) {
+	resp.ErrCode = merr.ErrCode()
+	resp.Message = merr.ErrMessage()
+	resp.Details = merr.ErrDetails()
 }
 
 func invoke(m MethodMeta, params ...reflect.Value) invokeResult {
@@ -325,7 +745,7 @@ func invoke(m MethodMeta, params ...reflect.Value) invokeResult {
 	if len(m.ReturnType) <= 1 {
 		if !ir.values[0].IsNil() {
 			//其实就是个err
-			ir.err = ir.values[0]
+			ir.err = ir.values[0].Interface()
 		}
 	}
 
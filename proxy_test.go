@@ -3,12 +3,15 @@ package core
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/blackbeans/turbo"
+	"github.com/prometheus/client_golang/prometheus"
 
 	_ "fmt"
 )
@@ -62,11 +65,16 @@ func MoaRequest2Raw(req *MoaReqPacket) *MoaRawReqPacket {
 }
 
 func testInitMoaStat(t testing.TB) *MoaStat {
-	return NewMoaStat("hostname",
+	stat, err := NewMoaStat("hostname",
 		"serviceUri",
 		turbo.NewLimitPool(context.Background(), 100),
 		func(serviceUri, host string, moainfo MoaInfo) {},
-		func() turbo.NetworkStat { return turbo.NetworkStat{} })
+		func() map[string]turbo.NetworkStat { return map[string]turbo.NetworkStat{} },
+		prometheus.NewRegistry())
+	if nil != err {
+		t.Fatal(err)
+	}
+	return stat
 }
 
 func TestInvocationHandler(t *testing.T) {
@@ -192,3 +200,414 @@ func TestComplexSliceJsonParams(t *testing.T) {
 		return nil
 	})
 }
+
+func TestInvocationHandlerAddRemoveService(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "demo",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil)}}, stat)
+
+	//重复发布
+	err := handler.AddService(Service{ServiceUri: "demo",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil)})
+	if nil == err {
+		t.Fatal("duplicate service should fail")
+	}
+
+	//没有实现接口
+	err = handler.AddService(Service{ServiceUri: "demo2",
+		Instance: Demo{}, Interface: (*IProxyDemo)(nil)})
+	if nil == err {
+		t.Fatal("invalid service should fail")
+	}
+
+	err = handler.AddService(Service{ServiceUri: "demo2",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil)})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	req := &MoaReqPacket{}
+	req.ServiceUri = "demo2"
+	req.Params.Args = []interface{}{"fuck", []string{"a", "b"}, ProxyParam{"you"}}
+	req.Params.Method = "ProxyDemoSlice"
+	req.Timeout = 5 * time.Second
+	handler.Invoke(context.TODO(), *MoaRequest2Raw(req), func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_SERVER_SUCC {
+			t.Errorf("TestInvocationHandlerAddRemoveService|Invoke|%v", resp)
+		}
+		return nil
+	})
+
+	if !handler.RemoveService("demo2") {
+		t.Fatal("remove service fail")
+	}
+	handler.Invoke(context.TODO(), *MoaRequest2Raw(req), func(resp MoaRespPacket) error {
+		if resp.ErrCode != CODE_SERVICE_NOT_FOUND {
+			t.Errorf("TestInvocationHandlerAddRemoveService|Removed|%v", resp)
+		}
+		return nil
+	})
+	if handler.RemoveService("demo2") {
+		t.Fatal("remove not exist service should fail")
+	}
+}
+
+func TestInvocationHandlerProcessTimeout(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	//方法不存在
+	_, err := newInvocationHandler([]Service{Service{ServiceUri: "demo",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil),
+		MethodTimeouts: map[string]time.Duration{"NotExist": time.Second}}}, stat)
+	if nil == err {
+		t.Fatal("method timeout of not exist method should fail")
+	}
+
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "demo",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil),
+		Timeout:        200 * time.Millisecond,
+		MethodTimeouts: map[string]time.Duration{"proxyDemoSlice": 30 * time.Second}}}, stat)
+	handler.SetProcessTimeout(3 * time.Second)
+
+	if timeout := handler.ProcessTimeout("demo", "ProxyDemoSlice"); timeout != 30*time.Second {
+		t.Fatalf("method timeout %s", timeout)
+	}
+	if timeout := handler.ProcessTimeout("demo", "ProxyDemo"); timeout != 200*time.Millisecond {
+		t.Fatalf("service timeout %s", timeout)
+	}
+	if timeout := handler.ProcessTimeout("demo2", "ProxyDemo"); timeout != 3*time.Second {
+		t.Fatalf("default timeout %s", timeout)
+	}
+
+	req := &MoaReqPacket{}
+	req.ServiceUri = "demo"
+	req.Params.Args = []interface{}{"fuck", []string{"a", "b"}, ProxyParam{"you"}}
+	req.Params.Method = "ProxyDemoSlice"
+	req.Timeout = 5 * time.Second
+	raw := MoaRequest2Raw(req)
+	raw.Source = "127.0.0.1:1000"
+	handler.Invoke(context.TODO(), *raw, func(resp MoaRespPacket) error { return nil })
+
+	invokes := handler.ListInvokes("demo")
+	if len(invokes) != 2 || len(invokes[1].Methods) != 1 ||
+		invokes[1].Methods[0].Timeout != int64(30*time.Second/time.Millisecond) {
+		t.Fatalf("ListInvokes %v", invokes)
+	}
+	//没有调用过的方法也列出生效的超时
+	all := invokes[0]
+	if all.Client != "*" || len(all.Methods) != reflect.TypeOf((*IProxyDemo)(nil)).Elem().NumMethod() {
+		t.Fatalf("ListInvokes all methods %v", all)
+	}
+	for _, m := range all.Methods {
+		timeout, count := int64(200), int64(0)
+		if m.Name == "ProxyDemoSlice" {
+			timeout, count = 30*1000, 1
+		}
+		if m.Timeout != timeout || m.Count != count {
+			t.Fatalf("ListInvokes method %v", m)
+		}
+	}
+
+	//没有任何调用时同样列出所有方法
+	idle := NewInvocationHandler([]Service{Service{ServiceUri: "demo",
+		Instance: DemoProxy{}, Interface: (*IProxyDemo)(nil),
+		Timeout: 200 * time.Millisecond}}, stat)
+	if invokes := idle.ListInvokes("demo"); len(invokes) != 1 || len(invokes[0].Methods) != len(all.Methods) {
+		t.Fatalf("ListInvokes without invocation %v", invokes)
+	}
+}
+
+type IBizDemo interface {
+	Biz(code int) (ProxyResult, error)
+	Plain(text string) (ProxyResult, error)
+	Check(code int) error
+}
+
+type BizDemo struct {
+}
+
+func (self BizDemo) Biz(code int) (ProxyResult, error) {
+	return ProxyResult{}, NewMoaError(code, "balance not enough", map[string]int{"balance": 10})
+}
+
+func (self BizDemo) Plain(text string) (ProxyResult, error) {
+	return ProxyResult{Text: text}, errors.New("plain error")
+}
+
+func (self BizDemo) Check(code int) error {
+	return NewMoaError(code, "check fail", nil)
+}
+
+func TestInvokeMoaError(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "biz",
+		Instance: BizDemo{}, Interface: (*IBizDemo)(nil)}}, stat)
+
+	invoke := func(method string, arg interface{}) MoaRespPacket {
+		req := &MoaReqPacket{}
+		req.ServiceUri = "biz"
+		req.Params.Method = method
+		req.Params.Args = []interface{}{arg}
+		req.Timeout = 5 * time.Second
+		var result MoaRespPacket
+		handler.Invoke(context.TODO(), *MoaRequest2Raw(req), func(resp MoaRespPacket) error {
+			result = resp
+			return nil
+		})
+		return result
+	}
+
+	resp := invoke("Biz", 10001)
+	if resp.ErrCode != 10001 || resp.Message != "balance not enough" ||
+		resp.Details.(map[string]int)["balance"] != 10 {
+		t.Fatalf("TestInvokeMoaError|Biz|%v", resp)
+	}
+	raw, _ := json.Marshal(resp)
+	rawResp, err := Wrap2MoaRawResponse(raw)
+	if nil != err || rawResp.ErrCode != 10001 || string(rawResp.Details) != `{"balance":10}` {
+		t.Fatalf("TestInvokeMoaError|Marshal|%s|%v", string(raw), err)
+	}
+
+	//普通的error保持原来的行为
+	resp = invoke("Plain", "hello")
+	if resp.ErrCode != CODE_SERVER_SUCC || resp.Message != "Method Invoke Error plain error" || nil != resp.Details {
+		t.Fatalf("TestInvokeMoaError|Plain|%v", resp)
+	}
+
+	//只返回error
+	resp = invoke("Check", 10002)
+	if resp.ErrCode != 10002 || resp.Message != "check fail" {
+		t.Fatalf("TestInvokeMoaError|Check|%v", resp)
+	}
+}
+
+type IGoOnlyDemo interface {
+	Join(sep string, texts ...string) (string, error)
+	Split(text string) (string, int, error)
+	Incr() error
+}
+
+type GoOnlyDemo struct {
+	count int
+}
+
+func (self *GoOnlyDemo) Join(sep string, texts ...string) (string, error) {
+	return strings.Join(texts, sep), nil
+}
+
+func (self *GoOnlyDemo) Split(text string) (string, int, error) {
+	return text, len(text), nil
+}
+
+func (self *GoOnlyDemo) Incr() error {
+	self.count++
+	return nil
+}
+
+func TestInvokeGoOnlySignatures(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	//默认的严格模式不支持可变参数和多返回值
+	_, err := newInvocationHandler([]Service{Service{ServiceUri: "goonly",
+		Instance: &GoOnlyDemo{}, Interface: (*IGoOnlyDemo)(nil)}}, stat)
+	if nil == err {
+		t.Fatal("strict mode should fail")
+	}
+
+	//指针接收者的方法使用值传入
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "goonly",
+		Instance: GoOnlyDemo{}, Interface: (*IGoOnlyDemo)(nil), Relaxed: true}}, stat)
+
+	invoke := func(method string, args ...interface{}) MoaRespPacket {
+		req := &MoaReqPacket{}
+		req.ServiceUri = "goonly"
+		req.Params.Method = method
+		req.Params.Args = args
+		req.Timeout = 5 * time.Second
+		var result MoaRespPacket
+		handler.Invoke(context.TODO(), *MoaRequest2Raw(req), func(resp MoaRespPacket) error {
+			result = resp
+			return nil
+		})
+		return result
+	}
+
+	if resp := invoke("Join", ",", "a", "b", "c"); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "a,b,c" {
+		t.Fatalf("TestInvokeGoOnlySignatures|Join|%v", resp)
+	}
+	if resp := invoke("Join", ","); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "" {
+		t.Fatalf("TestInvokeGoOnlySignatures|Join|Empty|%v", resp)
+	}
+	if resp := invoke("Join"); resp.ErrCode != CODE_SERIALIZATION {
+		t.Fatalf("TestInvokeGoOnlySignatures|Join|NoArgs|%v", resp)
+	}
+
+	resp := invoke("Split", "hello")
+	raw, _ := json.Marshal(resp.Result)
+	if resp.ErrCode != CODE_SERVER_SUCC || string(raw) != `["hello",5]` {
+		t.Fatalf("TestInvokeGoOnlySignatures|Split|%v", resp)
+	}
+
+	if resp := invoke("Incr"); resp.ErrCode != CODE_SERVER_SUCC || nil != resp.Result {
+		t.Fatalf("TestInvokeGoOnlySignatures|Incr|%v", resp)
+	}
+}
+
+type IConflictDemo interface {
+	GetName() (string, error)
+	Getname() (string, error)
+}
+
+type ConflictDemo struct {
+}
+
+func (self ConflictDemo) GetName() (string, error) {
+	return "GetName", nil
+}
+
+func (self ConflictDemo) Getname() (string, error) {
+	return "Getname", nil
+}
+
+func TestMethodConflictAndAlias(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	//大小写冲突
+	_, err := newInvocationHandler([]Service{Service{ServiceUri: "conflict",
+		Instance: ConflictDemo{}, Interface: (*IConflictDemo)(nil)}}, stat)
+	if nil == err {
+		t.Fatal("method name conflict should fail")
+	}
+
+	//别名和其他方法冲突
+	_, err = newInvocationHandler([]Service{Service{ServiceUri: "conflict",
+		Instance: ConflictDemo{}, Interface: (*IConflictDemo)(nil),
+		MethodAliases: map[string]string{"Getname": "getName"}}}, stat)
+	if nil == err {
+		t.Fatal("method alias conflict should fail")
+	}
+
+	//别名的方法不存在
+	_, err = newInvocationHandler([]Service{Service{ServiceUri: "conflict",
+		Instance: ConflictDemo{}, Interface: (*IConflictDemo)(nil),
+		MethodAliases: map[string]string{"NotExist": "getFullName"}}}, stat)
+	if nil == err {
+		t.Fatal("method alias of not exist method should fail")
+	}
+
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "conflict",
+		Instance: ConflictDemo{}, Interface: (*IConflictDemo)(nil),
+		MethodAliases:  map[string]string{"Getname": "getFullName"},
+		MethodTimeouts: map[string]time.Duration{"getFullName": 30 * time.Second}}}, stat)
+
+	invoke := func(method string) MoaRespPacket {
+		req := &MoaReqPacket{}
+		req.ServiceUri = "conflict"
+		req.Params.Method = method
+		req.Params.Args = []interface{}{}
+		req.Timeout = 5 * time.Second
+		var result MoaRespPacket
+		handler.Invoke(context.TODO(), *MoaRequest2Raw(req), func(resp MoaRespPacket) error {
+			result = resp
+			return nil
+		})
+		return result
+	}
+
+	if resp := invoke("getName"); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "GetName" {
+		t.Fatalf("TestMethodConflictAndAlias|getName|%v", resp)
+	}
+	if resp := invoke("getFullName"); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "Getname" {
+		t.Fatalf("TestMethodConflictAndAlias|getFullName|%v", resp)
+	}
+	if timeout := handler.ProcessTimeout("conflict", "getFullName"); timeout != 30*time.Second {
+		t.Fatalf("TestMethodConflictAndAlias|Timeout|%s", timeout)
+	}
+}
+
+type ITenantDemo interface {
+	Tenant() (string, error)
+}
+
+type TenantDemo struct {
+	name string
+}
+
+func (self TenantDemo) Tenant() (string, error) {
+	return self.name, nil
+}
+
+func TestInvokeServiceGroups(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	_, err := newInvocationHandler([]Service{
+		Service{ServiceUri: "/service/user", GroupId: "a", Instance: TenantDemo{"a"}, Interface: (*ITenantDemo)(nil)},
+		Service{ServiceUri: "/service/user", GroupId: "a", Instance: TenantDemo{"a"}, Interface: (*ITenantDemo)(nil)}}, stat)
+	if nil == err {
+		t.Fatal("duplicate service group should fail")
+	}
+
+	handler := NewInvocationHandler([]Service{
+		Service{ServiceUri: "/service/user", GroupId: "a", Instance: TenantDemo{"a"}, Interface: (*ITenantDemo)(nil)},
+		Service{ServiceUri: "/service/user", GroupId: "b", Instance: TenantDemo{"b"}, Interface: (*ITenantDemo)(nil)}}, stat)
+
+	invoke := func(action string, props map[string]string) MoaRespPacket {
+		req := &MoaReqPacket{}
+		req.ServiceUri = action
+		req.Params.Method = "Tenant"
+		req.Params.Args = []interface{}{}
+		req.Timeout = 5 * time.Second
+		raw := MoaRequest2Raw(req)
+		raw.Properties = props
+		var result MoaRespPacket
+		handler.Invoke(context.TODO(), *raw, func(resp MoaRespPacket) error {
+			result = resp
+			return nil
+		})
+		return result
+	}
+
+	if resp := invoke("/service/user#a", nil); resp.Result != "a" {
+		t.Fatalf("TestInvokeServiceGroups|Action|%v", resp)
+	}
+	if resp := invoke("/service/user", map[string]string{KEY_MOA_PROPERTY_GROUP: "b"}); resp.Result != "b" {
+		t.Fatalf("TestInvokeServiceGroups|Property|%v", resp)
+	}
+	//多个分组时必须指定分组
+	if resp := invoke("/service/user", nil); resp.ErrCode != CODE_SERVICE_NOT_FOUND {
+		t.Fatalf("TestInvokeServiceGroups|NoGroup|%v", resp)
+	}
+	if resp := invoke("/service/user#c", nil); resp.ErrCode != CODE_SERVICE_NOT_FOUND {
+		t.Fatalf("TestInvokeServiceGroups|NotExist|%v", resp)
+	}
+
+	//下线单个分组
+	if !handler.RemoveService("/service/user#a") {
+		t.Fatal("remove service group fail")
+	}
+	if resp := invoke("/service/user#a", nil); resp.ErrCode != CODE_SERVICE_NOT_FOUND {
+		t.Fatalf("TestInvokeServiceGroups|Removed|%v", resp)
+	}
+	//只剩一个分组时兼容没有指定分组的调用方
+	if resp := invoke("/service/user", nil); resp.Result != "b" {
+		t.Fatalf("TestInvokeServiceGroups|Single|%v", resp)
+	}
+
+	//*分组处理没有发布的分组
+	err = handler.AddService(Service{ServiceUri: "/service/user", Instance: TenantDemo{"*"}, Interface: (*ITenantDemo)(nil)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if resp := invoke("/service/user#c", nil); resp.Result != "*" {
+		t.Fatalf("TestInvokeServiceGroups|Default|%v", resp)
+	}
+	if resp := invoke("/service/user#b", nil); resp.Result != "b" {
+		t.Fatalf("TestInvokeServiceGroups|Group|%v", resp)
+	}
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+//每条规则最多保留的令牌桶数量,超过则重置,避免来源过多时内存无限增长
+const MAX_RATE_LIMIT_BUCKETS = 10000
+
+//限流规则,按照来源IP、调用方应用、服务、方法匹配
+//字段为空则不区分,为*则每个不同的值使用独立的令牌桶,否则需要完全匹配
+type RateLimit struct {
+	Name    string //规则名称,用于日志和统计
+	Source  string //调用方IP
+	App     string //调用方应用,取自属性moa.app
+	Service string //服务 uri 或者 uri#groupId
+	Method  string //方法名,不区分大小写
+	Rate    int    //每秒允许的请求数
+	Burst   int    //允许的突发请求数,默认为Rate
+}
+
+//限流规则以及对应的令牌桶
+type rateLimitRule struct {
+	RateLimit
+	lock    sync.Mutex
+	buckets map[string]*rate.Limiter
+}
+
+//令牌桶限流
+type RateLimiter struct {
+	rules []*rateLimitRule
+}
+
+func newRateLimiter(limits []RateLimit) (*RateLimiter, error) {
+	rules := make([]*rateLimitRule, 0, len(limits))
+	for i, l := range limits {
+		if l.Rate <= 0 {
+			return nil, fmt.Errorf("RateLimit Rate Invalid! [%s:%d]", l.Name, l.Rate)
+		}
+		if len(l.Name) <= 0 {
+			l.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if l.Burst <= 0 {
+			l.Burst = l.Rate
+		}
+		l.Method = strings.ToLower(l.Method)
+		rules = append(rules, &rateLimitRule{
+			RateLimit: l,
+			buckets:   make(map[string]*rate.Limiter, 16)})
+	}
+	return &RateLimiter{rules: rules}, nil
+}
+
+//请求是否允许通过,所有匹配的规则都需要允许,拒绝时返回对应的规则名称
+//uri、group为请求实际分发到的服务和分组
+func (self *RateLimiter) Allow(req MoaRawReqPacket, uri, group string) (string, bool) {
+	if nil == self || len(self.rules) <= 0 {
+		return "", true
+	}
+	source := sourceIP(req.Source)
+	method := strings.ToLower(req.Params.Method)
+	app := req.Properties[KEY_MOA_PROPERTY_APP]
+
+	//先预留所有匹配规则的令牌,任何一个规则拒绝则归还已经预留的令牌
+	now := time.Now()
+	reserved := make([]*rate.Reservation, 0, len(self.rules))
+	for _, rule := range self.rules {
+		key, ok := rule.match(source, app, uri, group, method)
+		if !ok {
+			continue
+		}
+		r := rule.reserve(key, now)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			for _, prev := range reserved {
+				prev.CancelAt(now)
+			}
+			return rule.Name, false
+		}
+		reserved = append(reserved, r)
+	}
+	return "", true
+}
+
+//是否匹配规则,匹配则返回令牌桶的key
+func (self *rateLimitRule) match(source, app, uri, group, method string) (string, bool) {
+	key := make([]string, 0, 4)
+	for _, f := range [][2]string{
+		{self.Source, source},
+		{self.App, app},
+		{self.Method, method}} {
+		switch f[0] {
+		case "":
+		case "*":
+			key = append(key, f[1])
+		default:
+			if f[0] != f[1] {
+				return "", false
+			}
+		}
+	}
+
+	switch self.Service {
+	case "":
+	case "*":
+		key = append(key, BuildServiceUri(uri, group))
+	default:
+		//没有指定分组则匹配服务的所有分组
+		if self.Service != uri && self.Service != BuildServiceUri(uri, group) {
+			return "", false
+		}
+	}
+	return strings.Join(key, "|"), true
+}
+
+//从key对应的令牌桶预留一个令牌
+func (self *rateLimitRule) reserve(key string, now time.Time) *rate.Reservation {
+	self.lock.Lock()
+	limiter, ok := self.buckets[key]
+	if !ok {
+		if len(self.buckets) >= MAX_RATE_LIMIT_BUCKETS {
+			self.buckets = make(map[string]*rate.Limiter, 16)
+		}
+		limiter = rate.NewLimiter(rate.Limit(self.Rate), self.Burst)
+		self.buckets[key] = limiter
+	}
+	self.lock.Unlock()
+	return limiter.ReserveN(now, 1)
+}
@@ -0,0 +1,164 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if _, err := newRateLimiter([]RateLimit{{Name: "zero"}}); nil == err {
+		t.Fatal("rate must be positive")
+	}
+
+	limiter, err := newRateLimiter([]RateLimit{
+		{Name: "per-ip", Source: "*", Service: "/service/lookup", Method: "getService", Rate: 1, Burst: 2},
+		{Name: "app", App: "bad-app", Rate: 1},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	req := func(source, action, method, app string) MoaRawReqPacket {
+		r := MoaRawReqPacket{ServiceUri: action, Source: source,
+			Properties: map[string]string{KEY_MOA_PROPERTY_APP: app}}
+		r.Params.Method = method
+		return r
+	}
+	allow := func(limiter *RateLimiter, r MoaRawReqPacket) (string, bool) {
+		uri, group := requestServiceUri(r.ServiceUri, r.Properties)
+		return limiter.Allow(r, uri, group)
+	}
+
+	//每个IP单独的令牌桶,方法名不区分大小写,服务不带分组则匹配所有分组
+	for i := 0; i < 2; i++ {
+		if _, ok := allow(limiter, req("10.0.0.1:1000", "/service/lookup#g1", "GetService", "")); !ok {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	if rule, ok := allow(limiter, req("10.0.0.1:1001", "/service/lookup", "getService", "")); ok || rule != "per-ip" {
+		t.Fatalf("request should be limited by per-ip %s", rule)
+	}
+	if _, ok := allow(limiter, req("10.0.0.2:1000", "/service/lookup", "getService", "")); !ok {
+		t.Fatal("other ip should be allowed")
+	}
+	//不匹配的方法、服务不限流
+	if _, ok := allow(limiter, req("10.0.0.1:1000", "/service/lookup", "setName", "")); !ok {
+		t.Fatal("other method should be allowed")
+	}
+	if _, ok := allow(limiter, req("10.0.0.1:1000", "/service/other", "getService", "")); !ok {
+		t.Fatal("other service should be allowed")
+	}
+
+	//所有调用方共享同一个令牌桶,Burst默认为1
+	if _, ok := allow(limiter, req("10.0.0.3:1000", "/service/other", "ping", "bad-app")); !ok {
+		t.Fatal("first request of app should be allowed")
+	}
+	if rule, ok := allow(limiter, req("10.0.0.4:1000", "/service/other", "ping", "bad-app")); ok || rule != "app" {
+		t.Fatalf("request should be limited by app %s", rule)
+	}
+
+	//没有规则都允许
+	var empty *RateLimiter
+	if _, ok := allow(empty, req("10.0.0.1:1000", "/service/lookup", "getService", "")); !ok {
+		t.Fatal("nil limiter should allow all")
+	}
+}
+
+//后面的规则拒绝时不消耗前面规则的令牌
+func TestRateLimiterAllOrNothing(t *testing.T) {
+	limiter, err := newRateLimiter([]RateLimit{
+		{Name: "service", Service: "/service/lookup", Rate: 2},
+		{Name: "app", App: "bad-app", Rate: 1},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	req := func(app string) MoaRawReqPacket {
+		r := MoaRawReqPacket{ServiceUri: "/service/lookup", Source: "10.0.0.1:1000",
+			Properties: map[string]string{KEY_MOA_PROPERTY_APP: app}}
+		r.Params.Method = "getService"
+		return r
+	}
+
+	if _, ok := limiter.Allow(req("bad-app"), "/service/lookup", ""); !ok {
+		t.Fatal("first request should be allowed")
+	}
+	if rule, ok := limiter.Allow(req("bad-app"), "/service/lookup", ""); ok || rule != "app" {
+		t.Fatalf("request should be limited by app %s", rule)
+	}
+	//service规则还剩一个令牌
+	if _, ok := limiter.Allow(req("good-app"), "/service/lookup", ""); !ok {
+		t.Fatal("rejected request should not consume service token")
+	}
+	if rule, ok := limiter.Allow(req("good-app"), "/service/lookup", ""); ok || rule != "service" {
+		t.Fatalf("request should be limited by service %s", rule)
+	}
+}
+
+//限流的指标使用发布的服务和方法名
+func TestRateLimitMetricLabels(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "/service/lookup", GroupId: "a",
+		Instance: demo, Interface: (*IHello)(nil)}}, stat)
+	limiter, err := newRateLimiter([]RateLimit{{Name: "all", Rate: 1}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	app := &Application{invokeHandler: handler, moaStat: stat, rateLimiter: limiter}
+
+	for _, c := range []struct{ action, method string }{
+		{"/service/lookup", "getservice"},
+		{"/service/lookup#*", "GetService"},
+		{"/service/random-1", "GetService"},
+		{"/service/lookup", "random-2"},
+	} {
+		req := MoaRawReqPacket{ServiceUri: c.action, Source: "10.0.0.1:1000"}
+		req.Params.Method = c.method
+		app.rateLimit(req)
+	}
+
+	counter := stat.MoaMetrics.RpcRateLimitedCounter
+	if limited := testutil.ToFloat64(counter.WithLabelValues("all", "/service/lookup#a", "GetService")); limited != 1 {
+		t.Fatalf("limited on published method %v", limited)
+	}
+	if limited := testutil.ToFloat64(counter.WithLabelValues("all", METRIC_LABEL_UNKNOWN, METRIC_LABEL_UNKNOWN)); limited != 1 {
+		t.Fatalf("limited on unknown service %v", limited)
+	}
+	if limited := testutil.ToFloat64(counter.WithLabelValues("all", "/service/lookup#a", METRIC_LABEL_UNKNOWN)); limited != 1 {
+		t.Fatalf("limited on unknown method %v", limited)
+	}
+	if n := testutil.CollectAndCount(counter); n != 3 {
+		t.Fatalf("rate limited label values should be bounded %d", n)
+	}
+}
+
+//不带分组的请求分发到唯一的分组服务时,按照分组服务的规则限流
+func TestRateLimitResolvedGroup(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+
+	demo := Demo{make(map[string][]string, 2), "/service/lookup"}
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "/service/lookup", GroupId: "a",
+		Instance: demo, Interface: (*IHello)(nil)}}, stat)
+	limiter, err := newRateLimiter([]RateLimit{{Name: "group", Service: "/service/lookup#a", Rate: 1}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	app := &Application{invokeHandler: handler, moaStat: stat, rateLimiter: limiter}
+
+	req := MoaRawReqPacket{ServiceUri: "/service/lookup", Source: "10.0.0.2:1000"}
+	req.Params.Method = "GetService"
+	if _, ok := app.rateLimit(req); !ok {
+		t.Fatal("first request should be allowed")
+	}
+	for _, action := range []string{"/service/lookup", "/service/lookup#*"} {
+		req.ServiceUri = action
+		if resp, ok := app.rateLimit(req); ok || resp.ErrCode != CODE_RATE_LIMITED {
+			t.Fatalf("%s should be limited by group rule %v", action, resp)
+		}
+	}
+}
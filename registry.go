@@ -2,7 +2,10 @@ package core
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
 )
 
 const (
@@ -14,45 +17,143 @@ type ConfigCenter struct {
 	registry IRegistry
 	services []Service
 	hostport string
+	//是否已经发布过服务
+	published bool
+	lock      sync.Mutex
 }
 
 //用于创建
 func NewConfigCenter(registryAddr,
 	hostport string, services []Service) *ConfigCenter {
+	center, err := newConfigCenter(registryAddr, hostport, services)
+	if nil != err {
+		panic(err.Error())
+	}
+	//	 zookeeper发布一次吧
+	center.RegisteAllServices()
+	return center
+}
+
+//创建ConfigCenter但是不发布服务,注册中心连接失败返回error
+func newConfigCenter(registryAddr,
+	hostport string, services []Service) (center *ConfigCenter, err error) {
 
 	uris := make([]string, 0, 10)
 	for _, s := range services {
 		uris = append(uris, BuildServiceUri(s.ServiceUri, s.GroupId))
 	}
+
+	//注册中心初始化失败是直接panic的
+	defer func() {
+		if crash := recover(); nil != crash {
+			center = nil
+			err = fmt.Errorf("ConfigCenter|Init|FAIL|%s|%v", registryAddr, crash)
+		}
+	}()
+
 	var reg IRegistry
 	if strings.HasPrefix(registryAddr, SCHEME_ZK) {
 		reg = NewZkRegistry(strings.TrimPrefix(registryAddr, SCHEME_ZK), uris, true)
 	} else if strings.HasPrefix(registryAddr, SCHEME_FILE) {
 		//本地文件配置
 		reg = NewFileRegistry(strings.TrimPrefix(registryAddr, SCHEME_FILE), uris, true)
+	} else {
+		return nil, fmt.Errorf("ConfigCenter|Unsupported Registry|%s", registryAddr)
 	}
-	center := &ConfigCenter{registry: reg, services: services, hostport: hostport}
-	//	 zookeeper发布一次吧
-	center.RegisteAllServices()
-	return center
+	return &ConfigCenter{registry: reg, services: services, hostport: hostport}, nil
 }
 
 func (self *ConfigCenter) RegisteAllServices() {
-	//注册服务
+	if err := self.registeAllServices(); nil != err {
+		panic(err.Error())
+	}
+}
+
+//注册服务,失败返回error
+func (self *ConfigCenter) registeAllServices() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, s := range self.services {
+		if err := self.registeService(s); nil != err {
+			//撤销已经注册成功的服务
+			for _, r := range self.services[:i] {
+				self.UnRegisteService(r.ServiceUri, self.hostport, PROTOCOL, r.GroupId)
+			}
+			return err
+		}
+	}
+	self.published = true
+	return nil
+}
+
+//注册单个服务,注册中心的失败是panic的
+func (self *ConfigCenter) registeService(s Service) (err error) {
+	defer func() {
+		if crash := recover(); nil != crash {
+			err = fmt.Errorf("ConfigCenter|RegisteService|FAIL|%s|%v", s.ServiceUri, crash)
+		}
+	}()
+	succ := self.RegisteService(s.ServiceUri, self.hostport, PROTOCOL, s.GroupId,
+		ServiceMeta{
+			ServiceUri:   s.ServiceUri,
+			GroupId:      s.GroupId,
+			IsPre:        s.IsPre,
+			ProtoVersion: PROTOCOL,
+			HostPort:     self.hostport,
+		})
+	if !succ {
+		return errors.New("ConfigCenter|RegisteAllServices|FAIL|" + s.ServiceUri)
+	}
+	return nil
+}
+
+//运行时增加服务,已经发布过则立即注册
+func (self *ConfigCenter) AddService(s Service) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.published {
+		if err := self.registeService(s); nil != err {
+			return err
+		}
+	}
+	self.services = append(self.services, s)
+	return nil
+}
+
+//运行时下线服务,serviceUri#groupId只注销该分组,否则注销所有分组
+func (self *ConfigCenter) RemoveService(serviceUri string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	found := false
+	services := make([]Service, 0, len(self.services))
 	for _, s := range self.services {
-		succ := self.RegisteService(s.ServiceUri, self.hostport, PROTOCOL, s.GroupId,
-			ServiceMeta{
-				ServiceUri:   s.ServiceUri,
-				GroupId:      s.GroupId,
-				IsPre:        s.IsPre,
-				ProtoVersion: PROTOCOL,
-				HostPort:     self.hostport,
-			})
-		if !succ {
-			panic("ConfigCenter|RegisteAllServices|FAIL|" + s.ServiceUri)
+		if !matchService(s, serviceUri) {
+			services = append(services, s)
+			continue
+		}
+		found = true
+		if self.published {
+			succ := self.UnRegisteService(s.ServiceUri, self.hostport, PROTOCOL, s.GroupId)
+			log.Infof("ConfigCenter|RemoveService|UnRegisteService|%v|%s|%s", succ, s.ServiceUri, s.GroupId)
 		}
 	}
+	self.services = services
+	return found
+}
 
+//注册中心下发的服务访问控制,注册中心不支持则没有
+func (self *ConfigCenter) GetAccessControls() ([]AccessControl, error) {
+	registry, ok := self.registry.(IAclRegistry)
+	if !ok {
+		return nil, nil
+	}
+	self.lock.Lock()
+	uris := make([]string, 0, len(self.services))
+	for _, s := range self.services {
+		uris = append(uris, BuildServiceUri(s.ServiceUri, s.GroupId))
+	}
+	self.lock.Unlock()
+	return registry.GetAccessControls(PROTOCOL, uris...)
 }
 
 func (self *ConfigCenter) RegisteService(serviceUri, hostport, protoType, groupid string, s ServiceMeta) bool {
@@ -72,6 +173,8 @@ func (self *ConfigCenter) GetService(serviceUri, protoType string, groupid strin
 }
 
 func (self *ConfigCenter) Destroy() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	//注册服务
 	for _, s := range self.services {
 		succ := self.UnRegisteService(s.ServiceUri, self.hostport, PROTOCOL, s.GroupId)
@@ -87,6 +190,7 @@ func (self *ConfigCenter) Destroy() {
 const (
 	// /moa/service/v1/service/relation-service#{groupId}/localhost:13000?timeout=1000&protocol=v1
 	ZK_MOA_ROOT_PATH  = "/moa/service"
+	ZK_MOA_ACL_PATH   = "/moa/acl"
 	ZK_ROOT           = "/"
 	ZK_PATH_DELIMITER = "/"
 
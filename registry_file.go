@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
+	"os"
 	"sort"
 	"strings"
 )
@@ -18,10 +19,19 @@ type LocalService struct {
 	HostPorts    []string `yaml:"hostports"`   //节点
 }
 
+//服务的访问控制
+type LocalAccessControl struct {
+	ServiceUri string   `yaml:"service_uri"` //serviceUri对应的服务名称
+	GroupId    string   `yaml:"gid"`         //该服务的分组,为空则对所有分组生效
+	Allow      []string `yaml:"allow"`       //允许的IP或者CIDR
+	Deny       []string `yaml:"deny"`        //拒绝的IP或者CIDR
+}
+
 type FileRegistry struct {
 	service      []string
 	uri2Services map[string][]ServiceMeta
 	serverModel  bool
+	yamlPath     string
 }
 
 func NewFileRegistry(yamlPath string, service []string, serverModel bool) *FileRegistry {
@@ -32,6 +42,7 @@ func NewFileRegistry(yamlPath string, service []string, serverModel bool) *FileR
 	zoo.service = service
 	zoo.uri2Services = uri2Services
 	zoo.serverModel = serverModel
+	zoo.yamlPath = yamlPath
 
 	if !serverModel {
 		// 加载本地的配置
@@ -126,6 +137,38 @@ func (self *FileRegistry) GetService(serviceUri, protoType, groupId string) ([]S
 	return validMetas, nil
 }
 
+//服务的访问控制,每次重新读取配置文件,文件不存在则没有访问控制
+func (self *FileRegistry) GetAccessControls(protoType string, serviceUris ...string) ([]AccessControl, error) {
+	rawYaml, err := ioutil.ReadFile(self.yamlPath)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var localAcls struct {
+		Acls []LocalAccessControl `yaml:"acls"`
+	}
+	err = yaml.Unmarshal(rawYaml, &localAcls)
+	if nil != err {
+		return nil, err
+	}
+
+	acls := make([]AccessControl, 0, len(localAcls.Acls))
+	for _, a := range localAcls.Acls {
+		uri := BuildServiceUri(a.ServiceUri, a.GroupId)
+		for _, s := range serviceUris {
+			//服务的任意分组匹配即可
+			if s == uri || strings.HasPrefix(s, uri+"#") {
+				acls = append(acls, AccessControl{Service: uri, Allow: a.Allow, Deny: a.Deny})
+				break
+			}
+		}
+	}
+	return acls, nil
+}
+
 //会话超时时，需要重新订阅/推送watcher
 func (self *FileRegistry) OnSessionExpired() {
 
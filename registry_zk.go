@@ -18,6 +18,11 @@ type IRegistry interface {
 	Destroy()
 }
 
+//可以下发服务访问控制的注册中心
+type IAclRegistry interface {
+	GetAccessControls(protoType string, serviceUris ...string) ([]AccessControl, error)
+}
+
 type ZkRegistry struct {
 	service      []string
 	zkManager    *ZKManager
@@ -167,6 +172,31 @@ func (self *ZkRegistry) GetService(serviceUri, protoType, groupId string) ([]Ser
 	return hosts, nil
 }
 
+//服务的访问控制
+// /moa/acl/v1/service/relation-service#{groupId} 节点数据为 {"allow":["10.0.0.0/8"],"deny":[]}
+func (self *ZkRegistry) GetAccessControls(protoType string, serviceUris ...string) ([]AccessControl, error) {
+	acls := make([]AccessControl, 0, len(serviceUris))
+	for _, uri := range serviceUris {
+		aclPath := concat(ZK_MOA_ACL_PATH, ZK_PATH_DELIMITER, protoType, uri)
+		rawNode, _, err := self.zkManager.session.Get(aclPath)
+		if err == zk.ErrNoNode {
+			continue
+		} else if nil != err {
+			return nil, err
+		}
+		if len(rawNode) <= 0 {
+			continue
+		}
+		var acl AccessControl
+		if err := json.Unmarshal(rawNode, &acl); nil != err {
+			return nil, fmt.Errorf("ZkRegistry|GetAccessControls|Invalid|%s|%v", aclPath, err)
+		}
+		acl.Service = uri
+		acls = append(acls, acl)
+	}
+	return acls, nil
+}
+
 //会话超时时，需要重新订阅/推送watcher
 func (self *ZkRegistry) OnSessionExpired() {
 	if self.serverModel {
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+//进行中的调用
+type flightCall struct {
+	done chan struct{}
+	resp MoaRespPacket
+}
+
+//相同参数的并发调用只执行一次,所有调用共享同一个结果
+type singleflight struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newSingleflight() *singleflight {
+	return &singleflight{calls: make(map[string]*flightCall, 16)}
+}
+
+//执行调用,shared为true表示复用了其他调用的结果
+//等待中的调用超时或者被取消则不再等待
+func (self *singleflight) do(ctx context.Context, key string, fn func() MoaRespPacket) (resp MoaRespPacket, shared bool) {
+	self.lock.Lock()
+	if call, ok := self.calls[key]; ok {
+		self.lock.Unlock()
+		select {
+		case <-call.done:
+			return call.resp, true
+		case <-ctx.Done():
+			return MoaRespPacket{ErrCode: CODE_TIMEOUT_SERVER,
+				Message: fmt.Sprintf(MSG_TIMEOUT, ctx.Err())}, true
+		}
+	}
+	call := &flightCall{done: make(chan struct{})}
+	self.calls[key] = call
+	self.lock.Unlock()
+
+	defer func() {
+		//执行异常也需要唤醒等待的调用
+		if crash := recover(); nil != crash {
+			call.resp = MoaRespPacket{ErrCode: CODE_INVOCATION_TARGET,
+				Message: fmt.Sprintf(MSG_INVOCATION_TARGET, fmt.Sprintf("%v", crash))}
+			self.finish(key, call)
+			panic(crash)
+		}
+	}()
+	call.resp = fn()
+	self.finish(key, call)
+	return call.resp, false
+}
+
+func (self *singleflight) finish(key string, call *flightCall) {
+	self.lock.Lock()
+	delete(self.calls, key)
+	self.lock.Unlock()
+	close(call.done)
+}
+
+//合并相同参数的并发调用
+func (self *InvocationHandler) singleflightInterceptor(ctx context.Context, invocation *Invocation, next Invoker) MoaRespPacket {
+	s, ok := self.lookupService(invocation.ServiceUri, invocation.GroupId)
+	if !ok {
+		return next(ctx, invocation)
+	}
+	m := s.methods[strings.ToLower(invocation.Method)]
+	if nil == m.flight {
+		return next(ctx, invocation)
+	}
+
+	resp, shared := m.flight.do(ctx, canonicalArgs(invocation.Args), func() MoaRespPacket {
+		return next(ctx, invocation)
+	})
+	if shared {
+		self.moaStat.IncrCoalesced(BuildServiceUri(s.ServiceUri, s.GroupId), m.Name)
+	}
+	return resp
+}
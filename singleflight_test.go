@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSingleflight(t *testing.T) {
+	flight := newSingleflight()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		flight.do(context.TODO(), "k", func() MoaRespPacket {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	//等待的调用超时不再等待
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if resp, shared := flight.do(ctx, "k", func() MoaRespPacket { return MoaRespPacket{} }); !shared ||
+		resp.ErrCode != CODE_TIMEOUT_SERVER {
+		t.Fatalf("waiting call should time out %v", resp)
+	}
+
+	//执行异常时等待的调用也能返回
+	done := make(chan MoaRespPacket)
+	go func() {
+		resp, _ := flight.do(context.TODO(), "k", func() MoaRespPacket { return MoaRespPacket{} })
+		done <- resp
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if resp := <-done; resp.ErrCode != CODE_INVOCATION_TARGET {
+		t.Fatalf("panic should be shared %v", resp)
+	}
+	if len(flight.calls) != 0 {
+		t.Fatalf("finished calls should be removed %d", len(flight.calls))
+	}
+}
+
+func TestInvokeSingleflight(t *testing.T) {
+	stat := testInitMoaStat(t)
+	defer stat.Destroy()
+	called := int32(0)
+
+	if _, err := newInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+		MethodSingleflight: map[string]bool{"NotExist": true}}}, stat); nil == err {
+		t.Fatal("singleflight of not exist method should fail")
+	}
+
+	handler := NewInvocationHandler([]Service{Service{ServiceUri: "slow",
+		Instance: Slow{called: &called}, Interface: (*ISlow)(nil),
+		MethodSingleflight: map[string]bool{"wait": true}}}, stat)
+	invoke := func(arg string) MoaRespPacket {
+		raw := MoaRawReqPacket{ServiceUri: "slow", Timeout: 5 * time.Second, Source: "127.0.0.1:1000"}
+		raw.Params.Method = "Wait"
+		raw.Params.Args = []json.RawMessage{json.RawMessage(arg)}
+		resp, _ := handler.call(context.TODO(), raw)
+		return resp
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := invoke("100"); resp.ErrCode != CODE_SERVER_SUCC || resp.Result != "done" {
+				t.Errorf("shared result %v", resp)
+			}
+		}()
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&called) != 1 {
+		t.Fatalf("concurrent calls should be coalesced %d", called)
+	}
+	if coalesced := testutil.ToFloat64(stat.MoaMetrics.CoalescedCounter.WithLabelValues("slow", "Wait")); coalesced != 9 {
+		t.Fatalf("coalesced count %v", coalesced)
+	}
+
+	//执行结束后不再共享
+	invoke("1")
+	if atomic.LoadInt32(&called) != 2 {
+		t.Fatalf("sequential calls should not be coalesced %d", called)
+	}
+}
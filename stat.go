@@ -5,7 +5,6 @@ import (
 	"github.com/blackbeans/logx"
 	"github.com/blackbeans/turbo"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,11 +15,18 @@ import (
 const (
 	MAX_ROTATE_SIZE = 10
 	MOA_STAT_LOG    = "moa-stat"
+	//没有发布的服务或者方法在指标中的label
+	METRIC_LABEL_UNKNOWN = "unknown"
 )
 
 type Method struct {
 	Name  string `json:"name"`
 	Count int64  `json:"count"`
+	//生效的处理超时 ms
+	Timeout int64 `json:"timeout_ms"`
+	//当前并发数以及并发限制,0为不限制
+	Concurrency    int32 `json:"concurrency"`
+	MaxConcurrency int32 `json:"max_concurrency"`
 }
 
 type InvokePerClient struct {
@@ -34,9 +40,17 @@ type MoaInfo struct {
 	Proc           int64 `json:"proc"`
 	Error          int64 `json:"error"`
 	Timeout        int64 `json:"timeout"`
+	Cancel         int64 `json:"cancel"`
+	RateLimited    int64 `json:"rate_limited"`
+	CacheHit       int64 `json:"cache_hit"`
+	CacheMiss      int64 `json:"cache_miss"`
+	Coalesced      int64 `json:"coalesced"`
+	Duplicate      int64 `json:"duplicate"`
 	MoaInvokePool  int64 `json:"invoke_gos"` //moa的调用Pool
 	Connections    int64 `json:"conns"`
 	TotalGoroutine int64 `json:"total_gos"`
+	//每个监听地址的网络状态
+	Listeners map[string]turbo.NetworkStat `json:"listeners,omitempty"`
 }
 
 type MoaStatistic struct {
@@ -44,6 +58,12 @@ type MoaStatistic struct {
 	Proc    *turbo.Flow
 	Error   *turbo.Flow
 	Timeout *turbo.Flow
+	Cancel  *turbo.Flow
+	Limited *turbo.Flow
+	Hit     *turbo.Flow
+	Miss    *turbo.Flow
+	Shared  *turbo.Flow
+	Dup     *turbo.Flow
 }
 
 // prometheus metrics
@@ -53,13 +73,27 @@ type MoaMetrics struct {
 	RpcProcessTotalCounter prometheus.Counter
 	RpcErrorTotalCounter   prometheus.Counter
 	RpcTimeoutTotalCounter prometheus.Counter
+	RpcCancelTotalCounter  prometheus.Counter
 	// rpc请求耗时
 	RpcInvokeDurationSummary *prometheus.SummaryVec
 	// rpc gopool用量
 	InvokePoolMaxGauge   prometheus.Gauge
 	InvokePoolInuseGauge prometheus.Gauge
+	// 服务和方法的并发限制
+	BulkheadInuseGauge *prometheus.GaugeVec
+	BulkheadLimitGauge *prometheus.GaugeVec
+	// 限流拒绝的请求数
+	RpcRateLimitedCounter *prometheus.CounterVec
+	// 方法结果缓存命中、未命中数
+	CacheHitCounter  *prometheus.CounterVec
+	CacheMissCounter *prometheus.CounterVec
+	// 合并的并发调用数
+	CoalescedCounter *prometheus.CounterVec
+	// 幂等key重复的调用数
+	DuplicateCounter *prometheus.CounterVec
 
-	cllectors []prometheus.Collector
+	cllectors  []prometheus.Collector
+	registerer prometheus.Registerer
 }
 
 //
@@ -68,8 +102,9 @@ type MoaStat struct {
 	currMoaInfo *MoaStatistic
 	invokePool  *turbo.GPool
 	RotateSize  int32
-	network     func() turbo.NetworkStat
+	network     func() map[string]turbo.NetworkStat
 	MoaTicker   *time.Ticker
+	logDone     chan struct{}
 	lock        sync.RWMutex
 	monitor     func(serviceUri, host string, moainfo MoaInfo)
 	hostname    string
@@ -82,68 +117,133 @@ type MoaLog interface {
 	Destroy()
 }
 
+//指标注册到registerer上,注册失败(例如重复注册)时返回错误
 func NewMoaStat(hostname, serviceUri string,
 	invokePool *turbo.GPool,
-	moniotr func(serviceUri, host string, moainfo MoaInfo), network func() turbo.NetworkStat) *MoaStat {
+	moniotr func(serviceUri, host string, moainfo MoaInfo), network func() map[string]turbo.NetworkStat,
+	registerer prometheus.Registerer) (*MoaStat, error) {
 
 	// 初始化指标
 	// rpc请求数量
-	receiveTotalCounter := promauto.NewCounter(prometheus.CounterOpts{
+	receiveTotalCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "moa_server_rpc_receive_total",
 		Help: "The total number of received rpc call of a service's moa server",
 	})
-	processTotalCounter := promauto.NewCounter(prometheus.CounterOpts{
+	processTotalCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "moa_server_rpc_process_total",
 		Help: "The total number of processed rpc call of a service's moa server",
 	})
-	errorTotalCounter := promauto.NewCounter(prometheus.CounterOpts{
+	errorTotalCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "moa_server_rpc_error_total",
 		Help: "The total number of error rpc call of a service's moa server",
 	})
-	timeoutTotalCounter := promauto.NewCounter(prometheus.CounterOpts{
+	timeoutTotalCounter := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "moa_server_rpc_timeout_total",
 		Help: "The total number of timeout rpc call of a service's moa server",
 	})
+	cancelTotalCounter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "moa_server_rpc_cancel_total",
+		Help: "The total number of cancelled rpc call of a service's moa server",
+	})
 	// rpc 请求耗时
-	invokeDurationSummary := promauto.NewSummaryVec(prometheus.SummaryOpts{
+	invokeDurationSummary := prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name:       "moa_server_rpc_invoke_duration_seconds",
 		Help:       "Duration of rpc invoke cost",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 	}, []string{"method"})
 	// rpc gopool 用量
-	poolMaxGauge := promauto.NewGauge(prometheus.GaugeOpts{
+	poolMaxGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "moa_server_invoke_max_pool",
 		Help: "The max cap of invoke pool",
 	})
-	poolInuseGauge := promauto.NewGauge(prometheus.GaugeOpts{
+	poolInuseGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "moa_server_invoke_inuse_pool",
 		Help: "The current inuse invoke pool",
 	})
 
+	// 服务和方法的并发限制
+	bulkheadInuseGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "moa_server_bulkhead_inuse",
+		Help: "The current concurrency of service or method",
+	}, []string{"service", "method"})
+	bulkheadLimitGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "moa_server_bulkhead_limit",
+		Help: "The max concurrency of service or method",
+	}, []string{"service", "method"})
+
+	// 限流拒绝的请求数
+	rateLimitedCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "moa_server_rpc_rate_limited_total",
+		Help: "The total number of rate limited rpc call of a service's moa server",
+	}, []string{"rule", "service", "method"})
+
+	// 方法结果缓存
+	cacheHitCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "moa_server_cache_hit_total",
+		Help: "The total number of method result cache hits",
+	}, []string{"service", "method"})
+	cacheMissCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "moa_server_cache_miss_total",
+		Help: "The total number of method result cache misses",
+	}, []string{"service", "method"})
+	// 合并的并发调用
+	coalescedCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "moa_server_singleflight_coalesced_total",
+		Help: "The total number of calls sharing the result of an identical in-flight call",
+	}, []string{"service", "method"})
+	// 幂等key重复的调用
+	duplicateCounter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "moa_server_idempotent_duplicate_total",
+		Help: "The total number of calls answered with the stored response of the same idempotency key",
+	}, []string{"service", "method"})
+
 	moaStat := &MoaStat{
 		currMoaInfo: &MoaStatistic{
 			Recv:    &turbo.Flow{},
 			Proc:    &turbo.Flow{},
 			Error:   &turbo.Flow{},
 			Timeout: &turbo.Flow{},
+			Cancel:  &turbo.Flow{},
+			Limited: &turbo.Flow{},
+			Hit:     &turbo.Flow{},
+			Miss:    &turbo.Flow{},
+			Shared:  &turbo.Flow{},
+			Dup:     &turbo.Flow{},
 		},
 		MoaMetrics: &MoaMetrics{
 			RpcReceiveTotalCounter:   receiveTotalCounter,
 			RpcProcessTotalCounter:   processTotalCounter,
 			RpcErrorTotalCounter:     errorTotalCounter,
 			RpcTimeoutTotalCounter:   timeoutTotalCounter,
+			RpcCancelTotalCounter:    cancelTotalCounter,
 			RpcInvokeDurationSummary: invokeDurationSummary,
 			InvokePoolMaxGauge:       poolMaxGauge,
 			InvokePoolInuseGauge:     poolInuseGauge,
+			BulkheadInuseGauge:       bulkheadInuseGauge,
+			BulkheadLimitGauge:       bulkheadLimitGauge,
+			RpcRateLimitedCounter:    rateLimitedCounter,
+			CacheHitCounter:          cacheHitCounter,
+			CacheMissCounter:         cacheMissCounter,
+			CoalescedCounter:         coalescedCounter,
+			DuplicateCounter:         duplicateCounter,
 			cllectors: []prometheus.Collector{
 				receiveTotalCounter,
 				processTotalCounter,
 				errorTotalCounter,
 				timeoutTotalCounter,
+				cancelTotalCounter,
 				invokeDurationSummary,
 				poolMaxGauge,
 				poolInuseGauge,
+				bulkheadInuseGauge,
+				bulkheadLimitGauge,
+				rateLimitedCounter,
+				cacheHitCounter,
+				cacheMissCounter,
+				coalescedCounter,
+				duplicateCounter,
 			},
+			registerer: registerer,
 		},
 		invokePool: invokePool,
 		RotateSize: 0,
@@ -151,12 +251,26 @@ func NewMoaStat(hostname, serviceUri string,
 		monitor:    moniotr,
 		hostname:   hostname,
 		serviceUri: serviceUri}
-	return moaStat
+
+	for i, c := range moaStat.MoaMetrics.cllectors {
+		if err := registerer.Register(c); nil != err {
+			//回滚已经注册的指标
+			for _, registered := range moaStat.MoaMetrics.cllectors[:i] {
+				registerer.Unregister(registered)
+			}
+			return nil, err
+		}
+	}
+	return moaStat, nil
 }
 
 func (self *MoaStat) StartLog() {
 	ticker := time.NewTicker(time.Second * 1)
+	done := make(chan struct{})
+	self.lock.Lock()
 	self.MoaTicker = ticker
+	self.logDone = done
+	self.lock.Unlock()
 	go func() {
 		defer func() {
 			if err := recover(); nil != err {
@@ -168,9 +282,26 @@ func (self *MoaStat) StartLog() {
 		}()
 		logx.GetLogger(MOA_STAT_LOG).Infof("RECV PROC ERROR TIMEOUT Goroutine NetWork")
 		for {
-			<-ticker.C
-			stat := self.network()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			listeners := self.network()
+			//汇总所有监听地址的网络状态
+			stat := turbo.NetworkStat{}
+			for _, ls := range listeners {
+				stat.ReadCount += ls.ReadCount
+				stat.ReadBytes += ls.ReadBytes
+				stat.WriteCount += ls.WriteCount
+				stat.WriteBytes += ls.WriteBytes
+				stat.DisPoolSize += ls.DisPoolSize
+				stat.DisPoolCap += ls.DisPoolCap
+				stat.Connections += ls.Connections
+			}
+			self.lock.RLock()
 			size, invokeCap := self.invokePool.Monitor()
+			self.lock.RUnlock()
 
 			self.MoaMetrics.InvokePoolInuseGauge.Set(float64(size))
 			self.MoaMetrics.InvokePoolMaxGauge.Set(float64(invokeCap))
@@ -180,9 +311,16 @@ func (self *MoaStat) StartLog() {
 				Proc:           int64(self.currMoaInfo.Proc.Changes()),
 				Error:          int64(self.currMoaInfo.Error.Changes()),
 				Timeout:        int64(self.currMoaInfo.Timeout.Changes()),
+				Cancel:         int64(self.currMoaInfo.Cancel.Changes()),
+				RateLimited:    int64(self.currMoaInfo.Limited.Changes()),
+				CacheHit:       int64(self.currMoaInfo.Hit.Changes()),
+				CacheMiss:      int64(self.currMoaInfo.Miss.Changes()),
+				Coalesced:      int64(self.currMoaInfo.Shared.Changes()),
+				Duplicate:      int64(self.currMoaInfo.Dup.Changes()),
 				MoaInvokePool:  int64(size),
 				Connections:    int64(stat.Connections),
 				TotalGoroutine: int64(runtime.NumGoroutine()),
+				Listeners:      listeners,
 			}
 
 			network := fmt.Sprintf("R:%dKB/%d W:%dKB/%d Go:%d/%d CONN:%d", stat.ReadBytes/1024,
@@ -215,6 +353,13 @@ func (self *MoaStat) StartLog() {
 	}()
 }
 
+//调用池热更新后替换
+func (self *MoaStat) SetInvokePool(invokePool *turbo.GPool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.invokePool = invokePool
+}
+
 func (self *MoaStat) IncrRecv() {
 	self.currMoaInfo.Recv.Incr(1)
 	self.MoaMetrics.RpcReceiveTotalCounter.Inc()
@@ -235,18 +380,65 @@ func (self *MoaStat) IncrTimeout() {
 	self.MoaMetrics.RpcTimeoutTotalCounter.Inc()
 }
 
+func (self *MoaStat) IncrCancel() {
+	self.currMoaInfo.Cancel.Incr(1)
+	self.MoaMetrics.RpcCancelTotalCounter.Inc()
+}
+
+//限流拒绝的请求
+func (self *MoaStat) IncrRateLimited(rule, serviceUri, method string) {
+	self.currMoaInfo.Limited.Incr(1)
+	self.MoaMetrics.RpcRateLimitedCounter.WithLabelValues(rule, serviceUri, method).Inc()
+}
+
+//方法结果缓存命中
+func (self *MoaStat) IncrCacheHit(serviceUri, method string) {
+	self.currMoaInfo.Hit.Incr(1)
+	self.MoaMetrics.CacheHitCounter.WithLabelValues(serviceUri, method).Inc()
+}
+
+//方法结果缓存未命中
+func (self *MoaStat) IncrCacheMiss(serviceUri, method string) {
+	self.currMoaInfo.Miss.Incr(1)
+	self.MoaMetrics.CacheMissCounter.WithLabelValues(serviceUri, method).Inc()
+}
+
+//共享其他调用结果的调用
+func (self *MoaStat) IncrCoalesced(serviceUri, method string) {
+	self.currMoaInfo.Shared.Incr(1)
+	self.MoaMetrics.CoalescedCounter.WithLabelValues(serviceUri, method).Inc()
+}
+
+//幂等key重复的调用
+func (self *MoaStat) IncrDuplicate(serviceUri, method string) {
+	self.currMoaInfo.Dup.Incr(1)
+	self.MoaMetrics.DuplicateCounter.WithLabelValues(serviceUri, method).Inc()
+}
+
 func (self *MoaStat) GetMoaInfo() MoaInfo {
 	return self.preMoaInfo
 }
 
-func (self *MoaStat) Destroy() {
+//停止状态日志,指标仍然保留
+func (self *MoaStat) StopLog() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	if nil != self.MoaTicker {
 		self.MoaTicker.Stop()
+		self.MoaTicker = nil
+	}
+	if nil != self.logDone {
+		close(self.logDone)
+		self.logDone = nil
 	}
+}
+
+func (self *MoaStat) Destroy() {
+	self.StopLog()
 
 	if nil != self.MoaMetrics {
 		for _, c := range self.MoaMetrics.cllectors {
-			prometheus.DefaultRegisterer.Unregister(c)
+			self.MoaMetrics.registerer.Unregister(c)
 		}
 	}
 }
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	//默认的流控窗口,调用方通过STREAM_ACK增加
+	STREAM_WINDOW_SIZE = 16
+	//流控窗口的最大值
+	MAX_STREAM_WINDOW_SIZE = 1024
+)
+
+//流式方法返回的channel,由Application逐帧写出
+type ResultStream struct {
+	ch reflect.Value
+	//流结束时执行,例如释放并发限制
+	closers []func()
+	once    sync.Once
+}
+
+//流结束时执行fn,需要在流交给调用方之前注册
+func (self *ResultStream) onClose(fn func()) {
+	self.closers = append(self.closers, fn)
+}
+
+//流写完、中断或者被丢弃时调用,只执行一次
+func (self *ResultStream) close() {
+	self.once.Do(func() {
+		for _, fn := range self.closers {
+			fn()
+		}
+	})
+}
+
+//读取下一个结果,channel关闭时返回false
+func (self *ResultStream) next(ctx context.Context) (interface{}, bool, error) {
+	if self.ch.IsNil() {
+		return nil, false, nil
+	}
+	chosen, v, ok := reflect.Select([]reflect.SelectCase{
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: self.ch},
+		reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}})
+	if chosen == 1 {
+		return nil, false, ctx.Err()
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	return v.Interface(), true, nil
+}
+
+//流控窗口,没有credits时暂停写出,避免调用方处理慢时服务端缓存所有的结果
+type streamWindow struct {
+	credits int32
+	notify  chan struct{}
+}
+
+func newStreamWindow(credits int32) *streamWindow {
+	return &streamWindow{credits: credits, notify: make(chan struct{}, 1)}
+}
+
+//获取一个credit,没有则等待调用方的STREAM_ACK
+func (self *streamWindow) acquire(ctx context.Context) error {
+	for {
+		credits := atomic.LoadInt32(&self.credits)
+		if credits > 0 {
+			if atomic.CompareAndSwapInt32(&self.credits, credits, credits-1) {
+				return nil
+			}
+			continue
+		}
+		select {
+		case <-self.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+//调用方确认消费后增加credits
+func (self *streamWindow) release(credits int32) {
+	for {
+		curr := atomic.LoadInt32(&self.credits)
+		next := curr + credits
+		if next > MAX_STREAM_WINDOW_SIZE {
+			next = MAX_STREAM_WINDOW_SIZE
+		}
+		if atomic.CompareAndSwapInt32(&self.credits, curr, next) {
+			break
+		}
+	}
+	select {
+	case self.notify <- struct{}{}:
+	default:
+	}
+}
+
+//调用方通过moa.stream.window指定初始的窗口大小
+func streamWindowSize(props map[string]string) int32 {
+	if v, ok := props[KEY_MOA_PROPERTY_STREAM_WINDOW]; ok {
+		if size, err := strconv.Atoi(v); nil == err && size > 0 {
+			if size > MAX_STREAM_WINDOW_SIZE {
+				size = MAX_STREAM_WINDOW_SIZE
+			}
+			return int32(size)
+		}
+	}
+	return STREAM_WINDOW_SIZE
+}
@@ -49,7 +49,6 @@ func (self *ZKManager) Start() {
 	ss, eventChan, err := zk.Connect(strings.Split(self.zkhosts, ","), 5*time.Second)
 	if nil != err {
 		panic("连接zk失败..." + err.Error())
-		return
 	}
 	self.CreateNode(ss, ZK_MOA_ROOT_PATH+ZK_PATH_DELIMITER+PROTOCOL)
 	self.session = ss